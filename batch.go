@@ -0,0 +1,196 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/peanutzhen/peanutcache/singlefilght"
+)
+
+// batch 模块将并发的缓存未命中合并为一次批量获取
+// 数据源通常更擅长处理 WHERE id IN (...) 而不是大量的单行查询
+// 在一个短窗口内(或攒够最大批量时) 各个singleflight的加载被合并
+// 批量获取一次后 结果分发给各自的调用方
+
+const (
+	defaultBatchWindow = 2 * time.Millisecond
+	defaultMaxBatch    = 100
+)
+
+// BatchRetriever 要求对象实现从数据源批量获取数据的能力
+// 它同时也是 Retriever 使用它创建的 Group 会自动合并并发的加载
+type BatchRetriever interface {
+	Retriever
+	retrieveBatch(keys []string) ([][]byte, []error)
+}
+
+// BatchRetrieverFunc 批量获取keys对应的值
+// values[i]与errs[i]对应keys[i] errs为nil时代表全部成功
+// 不存在的key应在errs中返回 ErrNotFound
+type BatchRetrieverFunc func(keys []string) (values [][]byte, errs []error)
+
+func (f BatchRetrieverFunc) retrieveBatch(keys []string) ([][]byte, []error) {
+	return f(keys)
+}
+
+// retrieve 使 BatchRetrieverFunc 也能作为 Retriever 单独获取一个key
+func (f BatchRetrieverFunc) retrieve(key string) ([]byte, error) {
+	values, errs := f([]string{key})
+	if len(errs) > 0 && errs[0] != nil {
+		return nil, errs[0]
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("batch retriever returned no value for %s", key)
+	}
+	return values[0], nil
+}
+
+// WithBatchWindow 设置 BatchRetriever 合并加载的窗口与最大批量
+// 第一个加载到达后最多等待window 或攒够maxBatch个key后立即批量获取
+// 默认窗口为2ms 最大批量为100 Retriever 不是 BatchRetriever 时无效
+func WithBatchWindow(window time.Duration, maxBatch int) GroupOption {
+	return func(g *Group) {
+		if g.batcher == nil {
+			return
+		}
+		if window > 0 {
+			g.batcher.window = window
+		}
+		if maxBatch > 0 {
+			g.batcher.maxBatch = maxBatch
+		}
+	}
+}
+
+// batcher 收集等待中的加载并批量获取
+type batcher struct {
+	retriever BatchRetriever
+	window    time.Duration
+	maxBatch  int
+	stats     *Stats
+
+	mu      sync.Mutex
+	pending []*batchCall
+	timer   *time.Timer
+}
+
+// batchCall 是一次等待批量获取结果的加载
+type batchCall struct {
+	key   string
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+func newBatcher(r BatchRetriever, stats *Stats) *batcher {
+	return &batcher{
+		retriever: r,
+		window:    defaultBatchWindow,
+		maxBatch:  defaultMaxBatch,
+		stats:     stats,
+	}
+}
+
+// retrieve 将key加入当前批次 并等待批量获取的结果
+func (b *batcher) retrieve(key string) ([]byte, error) {
+	call := &batchCall{key: key, done: make(chan struct{})}
+	b.mu.Lock()
+	b.pending = append(b.pending, call)
+	switch {
+	case len(b.pending) >= b.maxBatch:
+		batch := b.takeLocked()
+		b.mu.Unlock()
+		go b.run(batch)
+	case len(b.pending) == 1:
+		b.timer = time.AfterFunc(b.window, b.flush)
+		b.mu.Unlock()
+	default:
+		b.mu.Unlock()
+	}
+	<-call.done
+	// 与单独获取时一样 批量获取的panic在调用方的goroutine中重新panic
+	if p, ok := call.err.(*singlefilght.PanicError); ok {
+		panic(p)
+	}
+	return call.value, call.err
+}
+
+// takeLocked 取出当前批次
+func (b *batcher) takeLocked() []*batchCall {
+	batch := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
+
+// flush 在窗口结束时批量获取当前批次
+func (b *batcher) flush() {
+	b.mu.Lock()
+	batch := b.takeLocked()
+	b.mu.Unlock()
+	if len(batch) > 0 {
+		b.run(batch)
+	}
+}
+
+// run 批量获取batch中的key 并将结果分发给每个调用方
+// retrieveBatch panic时 每个调用方都会收到 *singlefilght.PanicError 不会泄漏等待者
+func (b *batcher) run(batch []*batchCall) {
+	calls := make(map[string][]*batchCall, len(batch))
+	var keys []string
+	for _, call := range batch {
+		if _, ok := calls[call.key]; !ok {
+			keys = append(keys, call.key)
+		}
+		calls[call.key] = append(calls[call.key], call)
+	}
+	b.stats.BatchLoads.Add(1)
+
+	values, errs, perr := b.retrieveBatch(keys)
+	if perr != nil {
+		for _, call := range batch {
+			call.err = perr
+			close(call.done)
+		}
+		return
+	}
+	for i, key := range keys {
+		var value []byte
+		var err error
+		switch {
+		case len(errs) > 0 && len(errs) != len(keys), len(errs) == 0 && len(values) != len(keys):
+			err = fmt.Errorf("batch retriever returned %d values and %d errors for %d keys", len(values), len(errs), len(keys))
+		case len(errs) > 0 && errs[i] != nil:
+			err = errs[i]
+		case i < len(values):
+			value = values[i]
+		default:
+			err = fmt.Errorf("batch retriever returned no value for %s", key)
+		}
+		for _, call := range calls[key] {
+			call.value, call.err = value, err
+			close(call.done)
+		}
+	}
+}
+
+// retrieveBatch 调用retriever 并将panic转换为 *singlefilght.PanicError
+// run 通常在timer的goroutine中执行 panic无法被调用方recover 会导致进程退出
+func (b *batcher) retrieveBatch(keys []string) (values [][]byte, errs []error, perr *singlefilght.PanicError) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr = &singlefilght.PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	values, errs = b.retriever.retrieveBatch(keys)
+	return values, errs, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchDB 模拟支持 WHERE id IN (...) 的数据源 key以"missing"开头时不存在
+type batchDB struct {
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (db *batchDB) retriever() BatchRetrieverFunc {
+	return func(keys []string) ([][]byte, []error) {
+		db.mu.Lock()
+		db.batches = append(db.batches, keys)
+		db.mu.Unlock()
+		values := make([][]byte, len(keys))
+		errs := make([]error, len(keys))
+		for i, key := range keys {
+			if len(key) >= 7 && key[:7] == "missing" {
+				errs[i] = ErrNotFound
+				continue
+			}
+			values[i] = []byte("v-" + key)
+		}
+		return values, errs
+	}
+}
+
+func getConcurrently(t *testing.T, g *Group, keys []string) {
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			view, err := g.Get(key)
+			if len(key) >= 7 && key[:7] == "missing" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("%s: want ErrNotFound, got %v", key, err)
+				}
+				return
+			}
+			if err != nil || view.String() != "v-"+key {
+				t.Errorf("%s: got %s, %v", key, view, err)
+			}
+		}(key)
+	}
+	wg.Wait()
+}
+
+func TestGroup_BatchRetriever(t *testing.T) {
+	var db batchDB
+	g := newGroup(NewNode(), "users", 64<<10, db.retriever(), WithBatchWindow(50*time.Millisecond, 100))
+
+	keys := []string{"missing-1", "missing-2"}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, strconv.Itoa(i))
+	}
+	getConcurrently(t, g, keys)
+	if len(db.batches) != 1 || len(db.batches[0]) != len(keys) {
+		t.Fatalf("want 1 batch of %d keys, got %v", len(keys), db.batches)
+	}
+	if g.Stats.BatchLoads.Get() != 1 {
+		t.Fatalf("batch loads = %d", g.Stats.BatchLoads.Get())
+	}
+
+	// 已缓存的key不再访问数据源
+	getConcurrently(t, g, keys[2:])
+	if len(db.batches) != 1 {
+		t.Fatalf("cached keys should not be retrieved again, got %d batches", len(db.batches))
+	}
+}
+
+func TestGroup_BatchRetrieverMaxBatch(t *testing.T) {
+	var db batchDB
+	g := newGroup(NewNode(), "users", 2<<10, db.retriever(), WithBatchWindow(time.Second, 10))
+
+	var keys []string
+	for i := 0; i < 30; i++ {
+		keys = append(keys, strconv.Itoa(i))
+	}
+	start := time.Now()
+	getConcurrently(t, g, keys)
+	// 攒够最大批量时立即获取 无需等待窗口结束
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("full batches should not wait for the window, took %v", time.Since(start))
+	}
+	if len(db.batches) != 3 {
+		t.Fatalf("want 3 batches, got %d", len(db.batches))
+	}
+	for _, batch := range db.batches {
+		if len(batch) != 10 {
+			t.Fatalf("batch of %d keys exceeds max batch", len(batch))
+		}
+	}
+}
+
+func TestGroup_BatchRetrieverPanic(t *testing.T) {
+	var db batchDB
+	var panicked sync.Once
+	retriever := BatchRetrieverFunc(func(keys []string) ([][]byte, []error) {
+		panicked.Do(func() { panic("boom") })
+		return db.retriever()(keys)
+	})
+	g := newGroup(NewNode(), "users", 64<<10, retriever, WithBatchWindow(20*time.Millisecond, 100))
+
+	// 第一批的每个调用方都应收到panic 而不是永远阻塞或使进程退出
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			defer func() {
+				r := recover()
+				if r == nil || !strings.Contains(fmt.Sprint(r), "boom") {
+					t.Errorf("%s: want panic boom, got %v", key, r)
+				}
+			}()
+			g.Get(key)
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	// panic之后 batcher依然可用
+	getConcurrently(t, g, []string{"a", "b"})
+}
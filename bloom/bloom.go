@@ -0,0 +1,145 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package bloom
+
+// bloom 包实现了布隆过滤器
+// 用于记录数据源中已存在的key 从而在访问数据源之前拒绝一定不存在的key
+// 布隆过滤器只会误判存在(假阳性) 不会误判不存在
+// 注意: 布隆过滤器不支持删除 key被删除后仍会被判断为可能存在
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+const magic = "PBF1" // 序列化格式的标识与版本
+
+// maxK 是哈希函数个数的上限 假阳性率约为2^-k 更多的哈希函数没有意义
+const maxK = 64
+
+// Filter 是并发安全的布隆过滤器
+// 零值的Filter只能用于 UnmarshalBinary
+type Filter struct {
+	mu    sync.RWMutex
+	m     uint64   // 位数组长度
+	k     uint64   // 哈希函数个数
+	n     uint64   // 已添加的key个数 (包括重复添加)
+	words []uint64 // 位数组
+}
+
+// New 创建预计容纳n个key 假阳性率约为fpRate的布隆过滤器
+// fpRate取值范围为(0, 1) 越小占用的内存越多
+func New(n uint64, fpRate float64) *Filter {
+	if n == 0 {
+		n = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		panic("bloom: false positive rate must be in (0, 1)")
+	}
+	// m = -n*ln(p)/(ln2)^2 k = m/n*ln2
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	if k > maxK {
+		k = maxK
+	}
+	return newFilter(m, k)
+}
+
+func newFilter(m, k uint64) *Filter {
+	if m == 0 {
+		m = 1
+	}
+	return &Filter{m: m, k: k, words: make([]uint64, (m+63)/64)}
+}
+
+// hashes 使用双重哈希 h1+i*h2 模拟k个哈希函数
+func hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h.Write([]byte{0})
+	h2 := h.Sum64() | 1 // 保证h2为奇数 避免所有位置重合
+	return h1, h2
+}
+
+// Add 添加key
+func (f *Filter) Add(keys ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range keys {
+		h1, h2 := hashes(key)
+		for i := uint64(0); i < f.k; i++ {
+			bit := (h1 + i*h2) % f.m
+			f.words[bit/64] |= 1 << (bit % 64)
+		}
+		f.n++
+	}
+}
+
+// Test 判断key是否可能存在 返回false时key一定不存在
+func (f *Filter) Test(key string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.words[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Count 返回已添加的key个数
+func (f *Filter) Count() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.n
+}
+
+// MarshalBinary 将过滤器序列化 可用于在重启前保存过滤器
+// 格式: magic | m | k | n | 位数组 整数均为小端序uint64
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	b := make([]byte, len(magic)+8*(3+len(f.words)))
+	copy(b, magic)
+	p := b[len(magic):]
+	for _, v := range append([]uint64{f.m, f.k, f.n}, f.words...) {
+		binary.LittleEndian.PutUint64(p, v)
+		p = p[8:]
+	}
+	return b, nil
+}
+
+// UnmarshalBinary 从 MarshalBinary 的结果恢复过滤器 覆盖f原有的内容
+func (f *Filter) UnmarshalBinary(b []byte) error {
+	if len(b) < len(magic)+24 || string(b[:len(magic)]) != magic {
+		return errors.New("bloom: invalid filter data")
+	}
+	p := b[len(magic):]
+	m := binary.LittleEndian.Uint64(p)
+	k := binary.LittleEndian.Uint64(p[8:])
+	n := binary.LittleEndian.Uint64(p[16:])
+	p = p[24:]
+	// m接近2^64时(m+63)/64会溢出 因此用(m-1)/64+1计算位数组的长度
+	if m == 0 || k == 0 || k > maxK || len(p)%8 != 0 || uint64(len(p)/8) != (m-1)/64+1 {
+		return errors.New("bloom: corrupted filter data")
+	}
+	words := make([]uint64, len(p)/8)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(p[8*i:])
+	}
+	f.mu.Lock()
+	f.m, f.k, f.n, f.words = m, k, n, words
+	f.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package bloom
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestFilter_NoFalseNegative(t *testing.T) {
+	f := New(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add("key" + strconv.Itoa(i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.Test("key" + strconv.Itoa(i)) {
+			t.Fatalf("key%d was added but reported absent", i)
+		}
+	}
+	if f.Count() != 1000 {
+		t.Fatalf("count = %d, want 1000", f.Count())
+	}
+}
+
+func TestFilter_FalsePositiveRate(t *testing.T) {
+	for _, rate := range []float64{0.1, 0.01, 0.001} {
+		f := New(10000, rate)
+		for i := 0; i < 10000; i++ {
+			f.Add("key" + strconv.Itoa(i))
+		}
+		fp := 0
+		for i := 0; i < 100000; i++ {
+			if f.Test("absent" + strconv.Itoa(i)) {
+				fp++
+			}
+		}
+		if got := float64(fp) / 100000; got > 2*rate {
+			t.Fatalf("false positive rate %f, configured %f", got, rate)
+		}
+	}
+}
+
+func TestFilter_MarshalBinary(t *testing.T) {
+	f := New(100, 0.01)
+	f.Add("Tom", "Jack", "Sam")
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var restored Filter
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"Tom", "Jack", "Sam"} {
+		if !restored.Test(key) {
+			t.Fatalf("%s lost after restore", key)
+		}
+	}
+	if restored.Count() != 3 {
+		t.Fatalf("count = %d after restore, want 3", restored.Count())
+	}
+	// 恢复后可以继续添加
+	restored.Add("Ann")
+	if !restored.Test("Ann") {
+		t.Fatal("Ann should be present")
+	}
+
+	if err := restored.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Fatal("truncated data should be rejected")
+	}
+	if err := restored.UnmarshalBinary([]byte("garbage data here...........")); err == nil {
+		t.Fatal("garbage should be rejected")
+	}
+}
+
+// header 构造 m k n 之后跟随words个空字的序列化数据
+func header(m, k, n uint64, words int) []byte {
+	b := make([]byte, len(magic)+8*(3+words))
+	copy(b, magic)
+	binary.LittleEndian.PutUint64(b[len(magic):], m)
+	binary.LittleEndian.PutUint64(b[len(magic)+8:], k)
+	binary.LittleEndian.PutUint64(b[len(magic)+16:], n)
+	return b
+}
+
+func TestFilter_UnmarshalCorrupted(t *testing.T) {
+	valid := header(128, 3, 0, 2)
+	tests := map[string][]byte{
+		"truncated header":    valid[:len(magic)+20],
+		"zero m":              header(0, 3, 0, 0),
+		"zero k":              header(128, 0, 0, 2),
+		"too many hashes":     header(128, maxK+1, 0, 2),
+		"huge k":              header(128, math.MaxUint64, 0, 2),
+		"missing words":       header(128, 3, 0, 1),
+		"extra words":         header(128, 3, 0, 3),
+		"partial word":        append(header(128, 3, 0, 2), 0),
+		"overflowing m":       header(math.MaxUint64, 3, 0, 0),
+		"overflowing m by 63": header(math.MaxUint64-62, 3, 0, 0),
+	}
+	f := New(10, 0.01)
+	f.Add("Tom")
+	for name, data := range tests {
+		if err := f.UnmarshalBinary(data); err == nil {
+			t.Fatalf("%s: corrupted data should be rejected", name)
+		}
+	}
+	// 被拒绝的数据不会改变原有内容
+	if !f.Test("Tom") || f.Count() != 1 {
+		t.Fatal("rejected data should leave the filter unchanged")
+	}
+	if err := f.UnmarshalBinary(valid); err != nil {
+		t.Fatal(err)
+	}
+	if f.Test("Tom") {
+		t.Fatal("restored empty filter should not contain Tom")
+	}
+	// 极低的假阳性率同样不会超过哈希函数个数的上限
+	if k := New(10, 1e-30).k; k != maxK {
+		t.Fatalf("k = %d, want %d", k, maxK)
+	}
+}
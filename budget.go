@@ -0,0 +1,227 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// budget 模块让多个 Group 共享一份内存预算
+// 由 NewBudget 创建的预算将容量按策略分配给每个 Group Group 加入或离开时重新分配
+// 容量缩小的 Group 立即淘汰超出的记录
+// 由 NewSharedBudget 创建的预算不划分容量 各 Group 按需使用
+// 总用量超出预算时 按 EvictPolicy 在所有 Group 中挑选淘汰的记录
+
+// SplitPolicy 决定 Budget 如何在 Group 之间分配
+type SplitPolicy int
+
+const (
+	SplitFair     SplitPolicy = iota // 平均分配 忽略权重
+	SplitWeighted                    // 按 WithBudget 的权重比例分配
+)
+
+// EvictPolicy 决定共享预算超出时从哪个 Group 淘汰
+type EvictPolicy int
+
+const (
+	// EvictGlobalLRU 淘汰所有 Group 中最久未使用的记录
+	EvictGlobalLRU EvictPolicy = iota
+	// EvictPriority 优先淘汰权重(即优先级)最低的 Group 中最久未使用的记录
+	EvictPriority
+)
+
+// Budget 是多个 Group 共享的内存预算
+type Budget struct {
+	mu       sync.Mutex
+	maxBytes int64
+	shared   bool // 为true时不划分容量 按evict跨 Group 淘汰
+	split    SplitPolicy
+	evict    EvictPolicy
+	members  map[*cache]*member
+	joins    int64 // 已加入的成员数 用于 Stats 按加入顺序排列
+}
+
+type member struct {
+	node   *Node
+	name   string
+	weight int64
+	seq    int64 // 加入的顺序
+}
+
+// BudgetStats 是预算内一个 Group 的使用情况
+// 不同 Node 中可以存在同名的 Group 因此以 Node 与 Group 名共同区分
+type BudgetStats struct {
+	Node  *Node
+	Group string
+	CacheStats
+}
+
+// NewBudget 创建总容量为maxBytes 按split划分给各 Group 的预算
+func NewBudget(maxBytes int64, split SplitPolicy) *Budget {
+	return &Budget{
+		maxBytes: maxBytes,
+		split:    split,
+		members:  make(map[*cache]*member),
+	}
+}
+
+// NewSharedBudget 创建总容量为maxBytes 由各 Group 共享的预算
+// 超出预算时按policy跨 Group 淘汰 可以通过 WithMinBytes 为 Group 保留最低容量
+func NewSharedBudget(maxBytes int64, policy EvictPolicy) *Budget {
+	return &Budget{
+		maxBytes: maxBytes,
+		shared:   true,
+		evict:    policy,
+		members:  make(map[*cache]*member),
+	}
+}
+
+// WithBudget 让 Group 从b中分配容量 此时 NewGroup 的maxBytes被忽略
+// weight在 SplitWeighted 时为分配的比例 在 EvictPriority 时为优先级(越大越晚被淘汰)
+// 其他策略下忽略 小于等于0时视为1
+func WithBudget(b *Budget, weight int64) GroupOption {
+	return func(g *Group) {
+		b.join(g.cache, g.node, g.name, weight)
+	}
+}
+
+// WithMinBytes 为使用共享预算的 Group 保留最低容量
+// 用量不超过minBytes时 其他 Group 的增长不会淘汰它的记录
+func WithMinBytes(minBytes int64) GroupOption {
+	return func(g *Group) {
+		g.cache.mu.Lock()
+		g.cache.minBytes = minBytes
+		g.cache.mu.Unlock()
+	}
+}
+
+func (b *Budget) join(c *cache, node *Node, name string, weight int64) {
+	if weight <= 0 {
+		weight = 1
+	}
+	b.mu.Lock()
+	defer b.unlock()
+	c.budget = b
+	b.joins++
+	b.members[c] = &member{node: node, name: name, weight: weight, seq: b.joins}
+	b.rebalanceLocked()
+}
+
+func (b *Budget) leave(c *cache) {
+	b.mu.Lock()
+	defer b.unlock()
+	delete(b.members, c)
+	b.rebalanceLocked()
+}
+
+// unlock 释放b.mu 并通知持有锁期间各成员产生的淘汰
+func (b *Budget) unlock() {
+	members := make([]*cache, 0, len(b.members))
+	for c := range b.members {
+		members = append(members, c)
+	}
+	b.mu.Unlock()
+	for _, c := range members {
+		c.notify()
+	}
+}
+
+// Stats 返回预算内每个 Group 的使用情况 按 Group 加入预算的顺序排列
+func (b *Budget) Stats() []BudgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	caches := make([]*cache, 0, len(b.members))
+	for c := range b.members {
+		caches = append(caches, c)
+	}
+	sort.Slice(caches, func(i, j int) bool { return b.members[caches[i]].seq < b.members[caches[j]].seq })
+	stats := make([]BudgetStats, len(caches))
+	for i, c := range caches {
+		m := b.members[c]
+		stats[i] = BudgetStats{Node: m.node, Group: m.name, CacheStats: c.stats()}
+	}
+	return stats
+}
+
+// rebalanceLocked 重新计算每个成员的容量
+func (b *Budget) rebalanceLocked() {
+	if b.shared {
+		for c := range b.members {
+			c.setCapacity(0)
+		}
+		b.enforceLocked()
+		return
+	}
+	var total int64
+	for _, m := range b.members {
+		weight := m.weight
+		if b.split == SplitFair {
+			weight = 1
+		}
+		total += weight
+	}
+	for c, m := range b.members {
+		weight := m.weight
+		if b.split == SplitFair {
+			weight = 1
+		}
+		share := b.maxBytes * weight / total
+		if share <= 0 {
+			share = 1 // 0代表无限制 预算不足时至少不能无限制
+		}
+		c.setCapacity(share)
+	}
+}
+
+// enforce 在共享预算超出时跨 Group 淘汰记录
+func (b *Budget) enforce() {
+	if !b.shared {
+		return
+	}
+	b.mu.Lock()
+	defer b.unlock()
+	b.enforceLocked()
+}
+
+func (b *Budget) enforceLocked() {
+	var total int64
+	for c := range b.members {
+		total += c.size()
+	}
+	for total > b.maxBytes {
+		victim := b.victimLocked()
+		if victim == nil {
+			// 所有 Group 都在最低容量以内
+			return
+		}
+		total -= victim.removeOldest()
+	}
+}
+
+// victimLocked 按淘汰策略选择需要淘汰记录的缓存
+func (b *Budget) victimLocked() *cache {
+	var victim *cache
+	var victimTime time.Time
+	var victimWeight int64
+	for c, m := range b.members {
+		atime, ok := c.oldest()
+		if !ok {
+			continue
+		}
+		if victim != nil {
+			if b.evict == EvictPriority && m.weight != victimWeight {
+				if m.weight > victimWeight {
+					continue
+				}
+			} else if !atime.Before(victimTime) {
+				continue
+			}
+		}
+		victim, victimTime, victimWeight = c, atime, m.weight
+	}
+	return victim
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func kiloRetriever() Retriever {
+	return RetrieverFunc(func(key string) ([]byte, error) {
+		return bytes.Repeat([]byte("x"), 1<<10), nil
+	})
+}
+
+func TestBudget_Split(t *testing.T) {
+	node := NewNode()
+	b := NewBudget(1<<20, SplitFair)
+	a := node.NewGroup("a", 0, kiloRetriever(), WithBudget(b, 1))
+	if a.cache.capacity != 1<<20 {
+		t.Fatalf("single group should get the whole budget, got %d", a.cache.capacity)
+	}
+	c := node.NewGroup("c", 0, kiloRetriever(), WithBudget(b, 3))
+	if a.cache.capacity != 1<<19 || c.cache.capacity != 1<<19 {
+		t.Fatalf("fair split got %d and %d", a.cache.capacity, c.cache.capacity)
+	}
+	node.DestroyGroup("c")
+	if a.cache.capacity != 1<<20 {
+		t.Fatalf("capacity should be returned after destroy, got %d", a.cache.capacity)
+	}
+
+	w := NewBudget(1<<20, SplitWeighted)
+	a = node.NewGroup("a", 0, kiloRetriever(), WithBudget(w, 1))
+	c = node.NewGroup("c", 0, kiloRetriever(), WithBudget(w, 3))
+	if a.cache.capacity != 1<<18 || c.cache.capacity != 3<<18 {
+		t.Fatalf("weighted split got %d and %d", a.cache.capacity, c.cache.capacity)
+	}
+	// 同名 Group 被替换时旧的 Group 退出原预算
+	node.NewGroup("a", 1<<20, kiloRetriever())
+	if c.cache.capacity != 1<<20 {
+		t.Fatalf("replaced group should leave the budget, got %d", c.cache.capacity)
+	}
+}
+
+func TestBudget_EvictOnShrink(t *testing.T) {
+	node := NewNode()
+	b := NewBudget(64<<10, SplitFair)
+	a := node.NewGroup("a", 0, kiloRetriever(), WithBudget(b, 1))
+	for i := 0; i < 50; i++ {
+		a.Get(strconv.Itoa(i))
+	}
+	if size := a.cache.size(); size > 64<<10 || size < 32<<10 {
+		t.Fatalf("size = %d, want within budget", size)
+	}
+	node.NewGroup("c", 0, kiloRetriever(), WithBudget(b, 1))
+	if size := a.cache.size(); size > 32<<10 {
+		t.Fatalf("size = %d after shrinking to half the budget", size)
+	}
+}
+
+func fill(g *Group, prefix string, n int) {
+	for i := 0; i < n; i++ {
+		g.Get(prefix + strconv.Itoa(i))
+	}
+}
+
+func TestSharedBudget_GlobalLRU(t *testing.T) {
+	node := NewNode()
+	b := NewSharedBudget(32<<10, EvictGlobalLRU)
+	a := node.NewGroup("a", 0, kiloRetriever(), WithBudget(b, 1))
+	c := node.NewGroup("c", 0, kiloRetriever(), WithBudget(b, 1))
+
+	// a独占整个预算
+	fill(a, "a", 20)
+	if a.CacheStats().Bytes < 16<<10 {
+		t.Fatalf("a should use the idle budget, got %d", a.CacheStats().Bytes)
+	}
+	// a最近访问了a19 c增长时先淘汰a中更早的记录
+	a.Get("a19")
+	fill(c, "c", 20)
+	stats := b.Stats()
+	if total := budgetBytes(stats); total > 32<<10 {
+		t.Fatalf("total usage %d exceeds budget", total)
+	}
+	if stats[0].Group != "a" || stats[0].Evictions == 0 {
+		t.Fatal("a should have entries evicted by c's growth")
+	}
+	if _, _, ok := a.cache.get("a19"); !ok {
+		t.Fatal("recently used a19 should survive")
+	}
+	if _, _, ok := a.cache.get("a0"); ok {
+		t.Fatal("a0 is the globally oldest entry and should be evicted")
+	}
+}
+
+func TestSharedBudget_Priority(t *testing.T) {
+	node := NewNode()
+	b := NewSharedBudget(32<<10, EvictPriority)
+	low := node.NewGroup("low", 0, kiloRetriever(), WithBudget(b, 1))
+	high := node.NewGroup("high", 0, kiloRetriever(), WithBudget(b, 5))
+
+	fill(high, "h", 10)
+	fill(low, "l", 40)
+	// 低优先级的增长只能淘汰自己的记录
+	if high.CacheStats().Evictions != 0 || high.CacheStats().Items != 10 {
+		t.Fatalf("high priority group lost entries: %+v", high.CacheStats())
+	}
+	fill(high, "h", 30)
+	if low.CacheStats().Evictions == 0 || high.CacheStats().Items < 20 {
+		t.Fatalf("high priority growth should evict low first: low %+v high %+v", low.CacheStats(), high.CacheStats())
+	}
+}
+
+func TestSharedBudget_MinBytes(t *testing.T) {
+	node := NewNode()
+	b := NewSharedBudget(32<<10, EvictGlobalLRU)
+	a := node.NewGroup("a", 0, kiloRetriever(), WithBudget(b, 1), WithMinBytes(12<<10))
+	c := node.NewGroup("c", 0, kiloRetriever(), WithBudget(b, 1))
+
+	fill(a, "a", 20)
+	fill(c, "c", 40)
+	if got := a.CacheStats().Bytes; got < 12<<10 {
+		t.Fatalf("a should keep its guaranteed minimum, got %d", got)
+	}
+	if total := budgetBytes(b.Stats()); total > 32<<10 {
+		t.Fatalf("total usage %d exceeds budget", total)
+	}
+}
+
+func TestBudget_StatsAcrossNodes(t *testing.T) {
+	b := NewBudget(32<<10, SplitFair)
+	n1, n2 := NewNode(), NewNode()
+	g1 := n1.NewGroup("scores", 0, kiloRetriever(), WithBudget(b, 1))
+	n2.NewGroup("scores", 0, kiloRetriever(), WithBudget(b, 1))
+	fill(g1, "k", 3)
+
+	// 不同节点的同名 Group 分别统计
+	stats := b.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("want stats of 2 groups, got %+v", stats)
+	}
+	if stats[0].Node != n1 || stats[1].Node != n2 || stats[0].Group != "scores" || stats[1].Group != "scores" {
+		t.Fatalf("stats should be keyed by node and group in join order, got %+v", stats)
+	}
+	if stats[0].Items != 3 || stats[1].Items != 0 {
+		t.Fatalf("items = %d, %d, want 3, 0", stats[0].Items, stats[1].Items)
+	}
+}
+
+// budgetBytes 返回预算内所有 Group 占用的内存
+func budgetBytes(stats []BudgetStats) int64 {
+	var total int64
+	for _, s := range stats {
+		total += s.Bytes
+	}
+	return total
+}
@@ -4,6 +4,16 @@
 
 package peanutcache
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
 // byteview 模块定义读取缓存结果
 // 实际上 byteview 只是简单的封装了byte slice，让其只读。
 // 试想一下，直接返回slice，在golang里，一切参数按值传递。
@@ -12,8 +22,70 @@ package peanutcache
 // 我们的缓存底层是存储在LRU的双向链表的Element里，因此
 // 可以被恶意修改。因此需要将slice封装成只读的ByteView
 
+// 为了避免复制 ByteView 的底层可以是[]byte或string
+// b与z都为空时 value为s
 type ByteView struct {
 	b []byte
+	s string
+	z *lazyView // 非空时value以压缩形式保存 首次访问时解压
+}
+
+// NewByteView 返回内容为b的 ByteView b会被复制 调用方之后仍可修改b
+func NewByteView(b []byte) ByteView {
+	return ByteView{b: cloneBytes(b)}
+}
+
+// StringView 返回内容为s的 ByteView string不可修改 因此不需要复制
+func StringView(s string) ByteView {
+	return ByteView{s: s}
+}
+
+// lazyView 持有压缩后的value 在首次访问时解压
+// 同一个 ByteView 的副本共享解压结果
+type lazyView struct {
+	once sync.Once
+	c    Compressor
+	data []byte // 压缩后的value
+	b    []byte // 解压后的value
+	err  error  // 解压失败的原因
+}
+
+// load 解压value 只会解压一次 失败时每次都返回同一个错误
+func (z *lazyView) load() ([]byte, error) {
+	z.once.Do(func() {
+		z.b, z.err = z.c.Decompress(z.data)
+		if z.err != nil {
+			z.err = fmt.Errorf("decompress value with %s failed: %w", z.c.Name(), z.err)
+		}
+	})
+	return z.b, z.err
+}
+
+// bytes 返回解压后的value 缓存返回的 ByteView 已解压成功
+// 只有淘汰回调收到的 ByteView 可能解压失败 此时返回nil
+func (z *lazyView) bytes() []byte {
+	b, err := z.load()
+	if err != nil {
+		log.Println(err)
+	}
+	return b
+}
+
+// isString 判断value是否以string保存
+func (v ByteView) isString() bool {
+	return v.z == nil && v.b == nil
+}
+
+// bytes 返回value 必要时先解压 以string保存的value会被复制
+// 返回值可能与缓存共享内存 调用方不能修改
+func (v ByteView) bytes() []byte {
+	if v.z != nil {
+		return v.z.bytes()
+	}
+	if v.b != nil {
+		return v.b
+	}
+	return []byte(v.s)
 }
 
 func cloneBytes(bytes []byte) []byte {
@@ -25,14 +97,125 @@ func cloneBytes(bytes []byte) []byte {
 // 注意到 ByteView 的方法接收者都是对象 这样是为了不影响调用对象本身
 
 func (v ByteView) Len() int {
-	return len(v.b)
+	if v.isString() {
+		return len(v.s)
+	}
+	return len(v.bytes())
 }
 
 // ByteSlice 返回一份[]byte的副本（深拷贝）
 func (v ByteView) ByteSlice() []byte {
-	return cloneBytes(v.b)
+	if v.isString() {
+		return []byte(v.s)
+	}
+	return cloneBytes(v.bytes())
 }
 
+// String 以string返回value 以string保存时不会复制
 func (v ByteView) String() string {
-	return string(v.b)
+	if v.isString() {
+		return v.s
+	}
+	return string(v.bytes())
+}
+
+// At 返回下标i处的字节
+func (v ByteView) At(i int) byte {
+	if v.isString() {
+		return v.s[i]
+	}
+	return v.bytes()[i]
+}
+
+// Slice 返回[from, to)之间的 ByteView 与v共享内存 不会复制
+func (v ByteView) Slice(from, to int) ByteView {
+	if v.isString() {
+		return ByteView{s: v.s[from:to]}
+	}
+	return ByteView{b: v.bytes()[from:to]}
+}
+
+// SliceFrom 返回从from开始的 ByteView 与v共享内存 不会复制
+func (v ByteView) SliceFrom(from int) ByteView {
+	return v.Slice(from, v.Len())
+}
+
+// Copy 将value复制到dest 返回复制的字节数
+func (v ByteView) Copy(dest []byte) int {
+	if v.isString() {
+		return copy(dest, v.s)
+	}
+	return copy(dest, v.bytes())
+}
+
+// Equal 判断v与v2的内容是否相同
+func (v ByteView) Equal(v2 ByteView) bool {
+	if v2.isString() {
+		return v.EqualString(v2.s)
+	}
+	return v.EqualBytes(v2.bytes())
+}
+
+// EqualString 判断v的内容是否与s相同
+func (v ByteView) EqualString(s string) bool {
+	if v.isString() {
+		return v.s == s
+	}
+	b := v.bytes()
+	if len(b) != len(s) {
+		return false
+	}
+	for i, c := range b {
+		if c != s[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// EqualBytes 判断v的内容是否与b相同
+func (v ByteView) EqualBytes(b []byte) bool {
+	if v.isString() {
+		return v.EqualString(string(b))
+	}
+	return bytes.Equal(v.bytes(), b)
+}
+
+// Reader 返回读取value的 io.ReadSeeker 不会复制
+func (v ByteView) Reader() io.ReadSeeker {
+	if v.isString() {
+		return strings.NewReader(v.s)
+	}
+	return bytes.NewReader(v.bytes())
+}
+
+// ReadAt 实现 io.ReaderAt
+func (v ByteView) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("view: invalid offset")
+	}
+	if off >= int64(v.Len()) {
+		return 0, io.EOF
+	}
+	n = v.SliceFrom(int(off)).Copy(p)
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// WriteTo 实现 io.WriterTo 将value直接写入w 不会复制
+// w不能修改或持有传入的[]byte
+func (v ByteView) WriteTo(w io.Writer) (n int64, err error) {
+	var m int
+	if v.isString() {
+		m, err = io.WriteString(w, v.s)
+	} else {
+		b := v.bytes()
+		m, err = w.Write(b)
+		if err == nil && m != len(b) {
+			err = io.ErrShortWrite
+		}
+	}
+	return int64(m), err
 }
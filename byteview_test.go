@@ -0,0 +1,77 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestByteView(t *testing.T) {
+	const s = "peanutcache"
+	views := map[string]ByteView{
+		"bytes":      NewByteView([]byte(s)),
+		"string":     StringView(s),
+		"compressed": {z: &lazyView{c: Snappy, data: mustCompress(t, Snappy, []byte(s))}},
+	}
+	for name, v := range views {
+		if v.Len() != len(s) || v.String() != s || !bytes.Equal(v.ByteSlice(), []byte(s)) {
+			t.Errorf("%s: got %q", name, v.String())
+		}
+		if v.At(1) != 'e' {
+			t.Errorf("%s: At(1) = %c", name, v.At(1))
+		}
+		if got := v.Slice(2, 6).String(); got != "anut" {
+			t.Errorf("%s: Slice(2, 6) = %q", name, got)
+		}
+		if got := v.SliceFrom(6).String(); got != "cache" {
+			t.Errorf("%s: SliceFrom(6) = %q", name, got)
+		}
+		for other, v2 := range views {
+			if !v.Equal(v2) {
+				t.Errorf("%s should equal %s", name, other)
+			}
+		}
+		if v.EqualString("peanut") || v.EqualBytes([]byte("peanutcachf")) {
+			t.Errorf("%s: should not equal different content", name)
+		}
+
+		p := make([]byte, 4)
+		if n, err := v.ReadAt(p, 2); n != 4 || err != nil || string(p) != "anut" {
+			t.Errorf("%s: ReadAt = %d, %v, %q", name, n, err, p)
+		}
+		if n, err := v.ReadAt(p, int64(len(s)-2)); n != 2 || err != io.EOF {
+			t.Errorf("%s: ReadAt at tail = %d, %v", name, n, err)
+		}
+		var buf bytes.Buffer
+		if n, err := v.WriteTo(&buf); n != int64(len(s)) || err != nil || buf.String() != s {
+			t.Errorf("%s: WriteTo = %d, %v, %q", name, n, err, buf.String())
+		}
+		if b, _ := ioutil.ReadAll(v.Reader()); string(b) != s {
+			t.Errorf("%s: Reader read %q", name, b)
+		}
+	}
+}
+
+func TestByteView_Immutable(t *testing.T) {
+	b := []byte("value")
+	v := NewByteView(b)
+	b[0] = 'V'
+	v.ByteSlice()[1] = 'A'
+	if v.String() != "value" {
+		t.Fatalf("view changed to %q", v.String())
+	}
+}
+
+func mustCompress(t *testing.T, c Compressor, b []byte) []byte {
+	t.Helper()
+	data, err := c.Compress(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -7,8 +7,12 @@ package peanutcache
 // cache 模块负责提供对lru模块的并发控制
 
 import (
+	"github.com/peanutzhen/peanutcache/disk"
 	"github.com/peanutzhen/peanutcache/lru"
+	"log"
 	"sync"
+	"time"
+	"unsafe"
 )
 
 // 这样设计可以进行cache和算法的分离，比如我现在实现了lfu缓存模块
@@ -16,7 +20,70 @@ import (
 type cache struct {
 	mu       sync.Mutex
 	lru      *lru.Cache
-	capacity int64 // 缓存最大容量
+	capacity int64         // 缓存最大容量
+	codec    Compressor    // 非空时value以压缩形式保存 lru按压缩后的大小计算容量
+	softTTL  time.Duration // 超过softTTL的value视为过时 为0时永不过时
+	hardTTL  time.Duration // 超过hardTTL的value将被删除 为0时永不删除
+	budget   *Budget       // 非空时capacity由 Budget 分配
+	minBytes int64         // 共享预算时 其他 Group 不能将本缓存淘汰到minBytes以下
+	tier     *disk.Store   // 非空时因容量淘汰的记录写入磁盘层
+
+	evictions int64 // 被淘汰的记录数
+
+	onEvict []EvictFunc // 记录离开缓存时的回调 创建后不再修改
+	reason  EvictReason // lru回调时的淘汰原因 除显式删除外均为 ReasonCapacity
+	pending []evicted   // 持有mu期间产生 等待释放锁后通知的淘汰
+}
+
+// CacheStats 是缓存的使用情况
+type CacheStats struct {
+	Bytes     int64 // 当前占用的内存 包括每条记录的额外开销
+	Capacity  int64 // 容量 0表示不限制(共享预算时由 Budget 统一限制)
+	Items     int64 // 记录条数
+	Evictions int64 // 被淘汰的记录数
+}
+
+// entry 是保存在lru中的记录 value为 ByteView 或 compressedValue
+type entry struct {
+	value lru.Lengthable
+	soft  time.Time // 零值表示永不过时
+	hard  time.Time // 零值表示永不过期
+	atime time.Time // 最近一次访问的时间 用于跨 Group 的LRU淘汰
+	ctime time.Time // 写入的时间
+	// loaded 是压缩的value解压后的字节数 首次访问解压成功后才计入容量
+	loaded int
+}
+
+// entryOverhead 是未压缩的记录中 entry 及其装箱的 ByteView 结构体占用的内存
+// value的字节数由value.Len计入
+var entryOverhead = int(unsafe.Sizeof(entry{}) + unsafe.Sizeof(ByteView{}))
+
+// compressedOverhead 是压缩的记录中 entry 装箱的 compressedValue 以及 lazyView 结构体占用的内存
+// 解压后的value由 entry.loaded 计入
+var compressedOverhead = int(unsafe.Sizeof(entry{}) + unsafe.Sizeof(compressedValue{}) + unsafe.Sizeof(lazyView{}))
+
+func (e *entry) Len() int {
+	if _, ok := e.value.(compressedValue); ok {
+		return e.value.Len() + e.loaded + compressedOverhead
+	}
+	return e.value.Len() + entryOverhead
+}
+
+// view 返回记录的value 压缩的value在首次访问时解压 之后的访问共享解压结果
+func (e *entry) view() ByteView {
+	if cv, ok := e.value.(compressedValue); ok {
+		return ByteView{z: cv.z}
+	}
+	return e.value.(ByteView)
+}
+
+// compressedValue 是保存在lru中的压缩value
+type compressedValue struct {
+	z *lazyView
+}
+
+func (v compressedValue) Len() int {
+	return len(v.z.data)
 }
 
 func newCache(capacity int64) *cache {
@@ -24,24 +91,237 @@ func newCache(capacity int64) *cache {
 }
 
 func (c *cache) add(key string, value ByteView) {
+	// 磁盘层中的旧value不再有效
+	c.dropTier(key)
+	c.put(key, value)
+	// 不能持有c.mu调用 Budget 否则与 Budget 淘汰其他缓存时的加锁顺序相反
+	if c.budget != nil {
+		c.budget.enforce()
+	}
+}
+
+// remove 从内存与磁盘层删除key 返回key是否存在
+func (c *cache) remove(key string) bool {
+	onDisk := c.dropTier(key)
+	c.mu.Lock()
+	defer c.unlock()
+	return c.deleteLocked(key, ReasonRemoved) || onDisk
+}
+
+// lruLocked 返回lru 第一次使用时创建
+func (c *cache) lruLocked() *lru.Cache {
+	if c.lru == nil {
+		c.lru = lru.New(c.capacity, func(key string, value lru.Lengthable) {
+			if c.reason == ReasonCapacity {
+				c.evictions++
+			}
+			c.evictedLocked(key, value, c.reason)
+		})
+	}
+	return c.lru
+}
+
+func (c *cache) put(key string, value ByteView) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.putLocked(key, value, time.Time{})
+}
+
+// putLocked 写入key hard非零时value最晚在hard过期
+// 替换已存在的key时记录一次 ReasonReplaced 新value超过容量时
+// lru会接着以 ReasonCapacity 淘汰它 因此一次写入可能对同一key产生两次淘汰
+func (c *cache) putLocked(key string, value ByteView, hard time.Time) {
+	e := &entry{value: value}
+	if c.codec != nil {
+		data, err := c.codec.Compress(value.bytes())
+		if err == nil {
+			e.value = compressedValue{z: &lazyView{c: c.codec, data: data}}
+		} else {
+			log.Printf("compress %s with %s failed: %v", key, c.codec.Name(), err)
+		}
+	}
+	now := time.Now()
+	e.atime, e.ctime = now, now
+	if c.softTTL > 0 {
+		e.soft = now.Add(c.softTTL)
+	}
+	if c.hardTTL > 0 {
+		e.hard = now.Add(c.hardTTL)
+	}
+	if !hard.IsZero() && (e.hard.IsZero() || hard.Before(e.hard)) {
+		e.hard = hard
+	}
+	if old, ok := c.lruLocked().Peek(key); ok {
+		c.evictedLocked(key, old, ReasonReplaced)
+	}
+	c.lru.Add(key, e)
+}
+
+// setCapacity 修改缓存容量 超出的记录将被淘汰
+func (c *cache) setCapacity(capacity int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = capacity
+	if c.lru != nil {
+		c.lru.SetCapacity(capacity)
+	}
+}
+
+// size 返回缓存当前占用的内存
+func (c *cache) size() int64 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.lru == nil {
+		return 0
+	}
+	return c.lru.Size()
+}
+
+// stats 返回缓存的使用情况
+func (c *cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CacheStats{Capacity: c.capacity, Evictions: c.evictions}
+	if c.lru != nil {
+		s.Bytes = c.lru.Size()
+		s.Items = int64(c.lru.Len())
+	}
+	return s
+}
+
+// entryStat 是一条记录的快照
+type entryStat struct {
+	key   string
+	size  int64
+	ctime time.Time
+	atime time.Time
+	hard  time.Time
+}
 
+// snapshot 返回全部记录的快照
+func (c *cache) snapshot() []entryStat {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.lru == nil {
-		c.lru = lru.New(c.capacity, nil)
+		return nil
 	}
-	c.lru.Add(key, value)
+	stats := make([]entryStat, 0, c.lru.Len())
+	c.lru.Range(func(key string, value lru.Lengthable) bool {
+		e := value.(*entry)
+		stats = append(stats, entryStat{
+			key:   key,
+			size:  int64(len(key)) + int64(e.Len()) + lru.EntryOverhead,
+			ctime: e.ctime,
+			atime: e.atime,
+			hard:  e.hard,
+		})
+		return true
+	})
+	return stats
 }
 
-func (c *cache) get(key string) (ByteView, bool) {
+// oldest 返回最久未使用记录的访问时间
+// 若淘汰该记录会使缓存低于minBytes 则不可被淘汰 返回false
+func (c *cache) oldest() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.lru == nil {
-		return ByteView{}, false
+		return time.Time{}, false
 	}
-	// 注意：Get操作需要修改lru中的双向链表，需要使用互斥锁。
+	key, v, ok := c.lru.Oldest()
+	if !ok {
+		return time.Time{}, false
+	}
+	size := int64(len(key)) + int64(v.Len()) + lru.EntryOverhead
+	if c.lru.Size()-size < c.minBytes {
+		return time.Time{}, false
+	}
+	return v.(*entry).atime, true
+}
+
+// removeOldest 淘汰最久未使用的记录 返回释放的内存
+// 由 Budget 持有锁时调用 淘汰由 Budget 释放锁后通知
+func (c *cache) removeOldest() int64 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if v, ok := c.lru.Get(key); ok {
-		return v.(ByteView), true
+	if c.lru == nil {
+		return 0
+	}
+	before := c.lru.Size()
+	c.lru.Remove()
+	return before - c.lru.Size()
+}
+
+// close 在 Group 销毁时调用 将容量归还给 Budget
+func (c *cache) close() {
+	if c.budget != nil {
+		c.budget.leave(c)
+	}
+}
+
+// get 返回key对应的value stale表示value已超过softTTL 需要刷新
+// 超过hardTTL的value将被删除 视为不存在
+// 压缩的value在这里解压 解压失败的记录已损坏 将被删除并视为不存在
+func (c *cache) get(key string) (value ByteView, stale bool, ok bool) {
+	e, stale, ok := c.lookup(key)
+	if !ok {
+		return
+	}
+	value = e.view()
+	if value.z == nil {
+		return value, stale, true
+	}
+	// 在锁外解压 同一记录只解压一次
+	b, err := value.z.load()
+	if err != nil {
+		log.Printf("drop corrupted %s: %v", originalKey(key), err)
+		c.mu.Lock()
+		defer c.unlock()
+		if cur, ok := c.lru.Peek(key); ok && cur == lru.Lengthable(e) {
+			c.deleteLocked(key, ReasonRemoved)
+		}
+		return ByteView{}, false, false
+	}
+	c.chargeLoaded(key, e, len(b))
+	return value, stale, true
+}
+
+// chargeLoaded 将记录解压后的n字节计入容量 每条记录只计入一次
+// 记录一直持有解压结果直到被淘汰 计入后可能淘汰其他记录或它自身
+func (c *cache) chargeLoaded(key string, e *entry, n int) {
+	c.mu.Lock()
+	charged := false
+	if cur, ok := c.lru.Peek(key); ok && cur == lru.Lengthable(e) && e.loaded == 0 && n > 0 {
+		e.loaded = n
+		c.lru.Resize(key)
+		charged = true
+	}
+	c.unlock()
+	// 与 add 相同 不能持有c.mu调用 Budget
+	if charged && c.budget != nil {
+		c.budget.enforce()
+	}
+}
+
+// lookup 返回key对应的记录 并更新访问时间
+func (c *cache) lookup(key string) (e *entry, stale bool, ok bool) {
+	// 注意：Get操作需要修改lru中的双向链表，需要使用互斥锁。
+	c.mu.Lock()
+	defer c.unlock()
+	if c.lru == nil {
+		return
+	}
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return
+	}
+	e = v.(*entry)
+	now := time.Now()
+	if !e.hard.IsZero() && now.After(e.hard) {
+		c.deleteLocked(key, ReasonExpired)
+		return nil, false, false
 	}
-	return ByteView{}, false
+	e.atime = now
+	stale = !e.soft.IsZero() && now.After(e.soft)
+	return e, stale, true
 }
@@ -9,48 +9,244 @@ import (
 	"fmt"
 	pb "github.com/peanutzhen/peanutcache/peanutcachepb"
 	"github.com/peanutzhen/peanutcache/registry"
+	"io"
+	"strconv"
 	"time"
 
-	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // client 模块实现peanutcache访问其他远程节点 从而获取缓存的能力
 
+// maxStreamPrealloc 是按peer声明的value长度预分配内存的上限
+// 长度来自peer 不可信 超出的部分随接收到的数据增长
+const maxStreamPrealloc = 4 << 20
+
 type client struct {
-	name string // 服务名称 pcache/ip:addr
+	name     string            // 服务名称 pcache/ip:addr
+	addr     string            // peer的地址 ip:addr
+	self     string            // 自身地址 用作租约的持有者
+	registry registry.Registry // 为空时使用默认的etcd
+	dialOpts []grpc.DialOption
+	ring     ringSyncer // 为空时不比对哈希环版本
+	// compressor 返回获取group时使用的gRPC compressor名称 为空表示不压缩
+	compressor func(group string) string
+}
+
+// ringSyncer 由持有哈希环的一方实现 用于与peer比对哈希环的版本
+type ringSyncer interface {
+	ringVersion() uint64
+	// ringMismatch 在peer的哈希环版本与自己不一致时被调用
+	ringMismatch(peer string, version uint64)
 }
 
 // Fetch 从remote peer获取对应缓存值
 func (c *client) Fetch(group string, key string) ([]byte, error) {
-	// 创建一个etcd client
-	cli, err := clientv3.New(defaultEtcdConfig)
+	return c.fetchAt(group, key, 0)
+}
+
+// fetchAt 从remote peer获取代数为gen的缓存值
+func (c *client) fetchAt(group, key string, gen uint64) ([]byte, error) {
+	in := &pb.GetRequest{Group: group, Key: key, Generation: gen}
+	var opts []grpc.CallOption
+	if c.compressor != nil {
+		if name := c.compressor(group); name != "" {
+			opts = append(opts, grpc.UseCompressor(name))
+		}
+	}
+	var value []byte
+	var header metadata.MD
+	err := c.call(func(ctx context.Context, grpcClient pb.PeanutCacheClient) error {
+		// 标记请求已被转发 并附带自己哈希环的版本
+		ctx = MarkForwarded(ctx)
+		if c.ring != nil {
+			ctx = metadata.AppendToOutgoingContext(ctx, mdRingVersion, strconv.FormatUint(c.ring.ringVersion(), 10))
+		}
+		var err error
+		value, header, err = c.fetchStream(ctx, grpcClient, in, opts...)
+		if status.Code(err) == codes.Unimplemented {
+			// peer不支持GetStream 退回到一次性获取
+			value, header, err = c.fetchUnary(ctx, grpcClient, in, opts...)
+		}
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not get %s/%s from peer %s: %w", group, key, c.name, err)
 	}
-	defer cli.Close()
-	// 发现服务 取得与服务的连接
-	conn, err := registry.EtcdDial(cli, c.name)
+	if c.ring != nil {
+		if version, ok := mdUint(header, mdRingVersion); ok && version != 0 && version != c.ring.ringVersion() {
+			c.ring.ringMismatch(c.name, version)
+		}
+	}
+
+	return value, nil
+}
+
+// fetchStream 通过GetStream分段获取value并重新拼接
+func (c *client) fetchStream(ctx context.Context, grpcClient pb.PeanutCacheClient, in *pb.GetRequest, opts ...grpc.CallOption) ([]byte, metadata.MD, error) {
+	stream, err := grpcClient.GetStream(ctx, in, opts...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer conn.Close()
-	grpcClient := pb.NewPeanutCacheClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	resp, err := grpcClient.Get(ctx, &pb.GetRequest{
-		Group: group,
-		Key:   key,
+	var value []byte
+	var size int64
+	for first := true; ; first = false {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if first {
+			size = chunk.GetSize()
+			if size < 0 {
+				return nil, nil, fmt.Errorf("peer sent invalid size %d", size)
+			}
+			prealloc := size
+			if prealloc > maxStreamPrealloc {
+				prealloc = maxStreamPrealloc
+			}
+			value = make([]byte, 0, prealloc)
+		}
+		if int64(len(value)+len(chunk.GetData())) > size {
+			return nil, nil, fmt.Errorf("peer sent more than %d bytes", size)
+		}
+		value = append(value, chunk.GetData()...)
+	}
+	if int64(len(value)) != size {
+		return nil, nil, fmt.Errorf("peer sent %d bytes, want %d", len(value), size)
+	}
+	header, err := stream.Header()
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, header, nil
+}
+
+// fetchUnary 通过Get一次性获取value
+func (c *client) fetchUnary(ctx context.Context, grpcClient pb.PeanutCacheClient, in *pb.GetRequest, opts ...grpc.CallOption) ([]byte, metadata.MD, error) {
+	var header metadata.MD
+	resp, err := grpcClient.Get(ctx, in, append(opts, grpc.Header(&header))...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.GetValue(), header, nil
+}
+
+// lease 向peer申请填充key的租约
+func (c *client) lease(group, key string) ([]byte, bool, bool, error) {
+	var resp *pb.LeaseResponse
+	err := c.call(func(ctx context.Context, grpcClient pb.PeanutCacheClient) error {
+		var err error
+		resp, err = grpcClient.Lease(ctx, &pb.LeaseRequest{Group: group, Key: key, Holder: c.self})
+		return err
 	})
 	if err != nil {
-		return nil, fmt.Errorf("could not get %s/%s from peer %s", group, key, c.name)
+		return nil, false, false, fmt.Errorf("could not lease %s/%s from peer %s: %w", group, key, c.name, err)
 	}
+	return resp.GetValue(), resp.GetFound(), resp.GetGranted(), nil
+}
 
-	return resp.GetValue(), nil
+// fill 将从数据源获取的值交给peer
+func (c *client) fill(group, key string, value []byte) error {
+	err := c.call(func(ctx context.Context, grpcClient pb.PeanutCacheClient) error {
+		_, err := grpcClient.Fill(ctx, &pb.FillRequest{Group: group, Key: key, Holder: c.self, Value: value})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not fill %s/%s to peer %s: %w", group, key, c.name, err)
+	}
+	return nil
+}
+
+// release 释放在peer上持有的key的租约
+func (c *client) release(group, key string) error {
+	err := c.call(func(ctx context.Context, grpcClient pb.PeanutCacheClient) error {
+		_, err := grpcClient.Fill(ctx, &pb.FillRequest{Group: group, Key: key, Holder: c.self, Release: true})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not release lease of %s/%s on peer %s: %w", group, key, c.name, err)
+	}
+	return nil
+}
+
+// bump 通知peer将prefix的代数增加到gen
+func (c *client) bump(group, prefix string, gen uint64) error {
+	err := c.call(func(ctx context.Context, grpcClient pb.PeanutCacheClient) error {
+		_, err := grpcClient.Bump(ctx, &pb.BumpRequest{Group: group, Prefix: prefix, Generation: gen})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not bump %s/%s on peer %s: %w", group, prefix, c.name, err)
+	}
+	return nil
+}
+
+// scan 列出peer本地缓存的记录
+func (c *client) scan(group, prefix string, limit int, cursor string) ([]EntryInfo, string, error) {
+	var resp *pb.ScanResponse
+	err := c.call(func(ctx context.Context, grpcClient pb.PeanutCacheClient) error {
+		var err error
+		resp, err = grpcClient.Scan(ctx, &pb.ScanRequest{Group: group, Prefix: prefix, Limit: int32(limit), Cursor: cursor})
+		return err
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("could not scan %s/%s on peer %s: %w", group, prefix, c.name, err)
+	}
+	entries := make([]EntryInfo, len(resp.GetEntries()))
+	for i, e := range resp.GetEntries() {
+		entries[i] = EntryInfo{
+			Key:  e.GetKey(),
+			Node: c.addr,
+			Size: e.GetSize(),
+			Age:  time.Duration(e.GetAge()),
+			Idle: time.Duration(e.GetIdle()),
+		}
+	}
+	return entries, resp.GetNext(), nil
+}
+
+// call 发现服务 取得与服务的连接并执行一次请求 返回的错误已由 fromStatus 还原
+func (c *client) call(fn func(ctx context.Context, grpcClient pb.PeanutCacheClient) error) error {
+	reg := c.registry
+	if reg == nil {
+		var err error
+		if reg, err = getDefaultRegistry(); err != nil {
+			return err
+		}
+	}
+	conn, err := registry.Dial(reg, c.name, c.dialOpts...)
+	if err != nil {
+		return fmt.Errorf("%w: dial %s: %v", ErrPeerUnavailable, c.name, err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return fromStatus(fn(ctx, pb.NewPeanutCacheClient(conn)))
 }
 
 func NewClient(service string) *client {
 	return &client{name: service}
 }
 
+// mdUint 从metadata中读取一个uint64
+func mdUint(md metadata.MD, key string) (uint64, bool) {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(values[0], 10, 64)
+	return v, err == nil
+}
+
 // 测试Client是否实现了Fetcher接口
 var _ Fetcher = (*client)(nil)
+var _ leaser = (*client)(nil)
+var _ generationFetcher = (*client)(nil)
+var _ bumper = (*client)(nil)
+var _ scanner = (*client)(nil)
@@ -0,0 +1,92 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// peanutproxy 是peanutcache的代理层
+// 它从服务发现中获取cache节点 维护唯一的一致性哈希环并转发请求
+//
+// 用法:
+//
+//	peanutproxy -addr :6320 -registry etcd -etcd localhost:2379
+//	peanutproxy -addr :6320 -registry static -peers 10.0.0.1:6324,10.0.0.2:6324
+//	peanutproxy -addr :6320 -registry file -file /etc/peanutcache/peers
+//	peanutproxy -addr :6320 -registry dns -domain cache.svc.cluster.local
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/peanutzhen/peanutcache/proxy"
+	"github.com/peanutzhen/peanutcache/registry"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	addr     = flag.String("addr", ":6320", "address the proxy listens on")
+	service  = flag.String("service", "peanutcache", "service name cache nodes register under")
+	backend  = flag.String("registry", "etcd", "service discovery backend: etcd, static, file or dns")
+	etcd     = flag.String("etcd", "localhost:2379", "comma separated etcd endpoints")
+	peers    = flag.String("peers", "", "comma separated cache node addresses for the static backend")
+	file     = flag.String("file", "", "peers file for the file backend")
+	domain   = flag.String("domain", "", "SRV domain for the dns backend")
+	interval = flag.Duration("interval", 5*time.Second, "poll interval for the file and dns backends")
+)
+
+func newRegistry() (registry.Registry, error) {
+	switch *backend {
+	case "etcd":
+		return registry.NewEtcd(clientv3.Config{
+			Endpoints:   strings.Split(*etcd, ","),
+			DialTimeout: 5 * time.Second,
+		})
+	case "static":
+		var endpoints []string
+		for _, peer := range strings.Split(*peers, ",") {
+			if peer != "" {
+				endpoints = append(endpoints, *service+"/"+peer)
+			}
+		}
+		return registry.NewStatic(endpoints...), nil
+	case "file":
+		return registry.NewFile(*file, *interval), nil
+	case "dns":
+		return registry.NewDNS(*domain, *interval), nil
+	}
+	return nil, fmt.Errorf("unknown registry backend %q", *backend)
+}
+
+func main() {
+	flag.Parse()
+	r, err := newRegistry()
+	if err != nil {
+		log.Fatal(err)
+	}
+	p, err := proxy.New(r, proxy.WithService(*service))
+	if err != nil {
+		log.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		p.Stop()
+	}()
+
+	log.Printf("peanutproxy is running at %s", lis.Addr())
+	if err := p.Serve(lis); err != nil {
+		log.Fatal(err)
+	}
+}
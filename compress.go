@@ -0,0 +1,150 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // 注册gRPC的gzip compressor
+)
+
+// compress 模块提供value的压缩能力
+// 使用 WithCompression 的 Group 在cache中保存压缩后的value 读取时按需解压
+// peer之间也会通过同名的gRPC compressor压缩传输
+
+// Compressor 定义了压缩/解压value的能力
+// 若Name与已注册的gRPC compressor同名 peer之间的请求也将使用它压缩
+type Compressor interface {
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	// Snappy 压缩速度最快 压缩率较低
+	Snappy Compressor = snappyCompressor{}
+	// Zstd 在压缩率与速度之间取得较好的平衡
+	Zstd Compressor = zstdCompressor{}
+	// Gzip 兼容性最好 速度最慢
+	Gzip Compressor = gzipCompressor{}
+)
+
+func init() {
+	encoding.RegisterCompressor(grpcCompressor{Snappy})
+	encoding.RegisterCompressor(grpcCompressor{Zstd})
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string { return "snappy" }
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+// zstd的Encoder与Decoder可以并发使用EncodeAll/DecodeAll 全局共享
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) Name() string { return "zstd" }
+
+func (zstdCompressor) Compress(src []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(src, nil), nil
+}
+
+func (zstdCompressor) Decompress(src []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(src, nil)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// grpcCompressor 将 Compressor 适配为gRPC的 encoding.Compressor
+// gRPC消息本身已完整在内存中 因此整块压缩即可
+type grpcCompressor struct {
+	c Compressor
+}
+
+func (g grpcCompressor) Name() string { return g.c.Name() }
+
+func (g grpcCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return &blockWriter{w: w, c: g.c}, nil
+}
+
+func (g grpcCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err := g.c.Decompress(src)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// blockWriter 缓存写入的数据 Close时一次性压缩并写出
+type blockWriter struct {
+	w   io.Writer
+	c   Compressor
+	buf bytes.Buffer
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func (b *blockWriter) Close() error {
+	data, err := b.c.Compress(b.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = b.w.Write(data)
+	return err
+}
+
+// grpcCompressorName 返回c对应的已注册gRPC compressor名称 未注册时返回空
+func grpcCompressorName(c Compressor) string {
+	if c == nil || encoding.GetCompressor(c.Name()) == nil {
+		return ""
+	}
+	return c.Name()
+}
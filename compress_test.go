@@ -0,0 +1,157 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"Tom","score":630}`), 100)
+	for _, c := range []Compressor{Snappy, Zstd, Gzip} {
+		data, err := c.Compress(value)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name(), err)
+		}
+		if len(data) >= len(value) {
+			t.Fatalf("%s did not compress: %d >= %d", c.Name(), len(data), len(value))
+		}
+		b, err := c.Decompress(data)
+		if err != nil || !bytes.Equal(b, value) {
+			t.Fatalf("%s round trip failed: %v", c.Name(), err)
+		}
+		if grpcCompressorName(c) != c.Name() {
+			t.Fatalf("%s is not registered as a gRPC compressor", c.Name())
+		}
+	}
+}
+
+func TestGroup_Compression(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"Tom","score":630}`), 100)
+	loads := 0
+	// 未压缩时容量只够存放一个value
+	g := newGroup(NewNode(), "blobs", int64(len(value))+100, RetrieverFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return value, nil
+		}), WithCompression(Zstd))
+
+	keys := []string{"a", "b", "c", "d"}
+	for _, k := range keys {
+		if _, err := g.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads != len(keys) || g.CacheStats().Items != int64(len(keys)) {
+		t.Fatalf("compressed values should all fit, got %d loads and %d items for %d keys",
+			loads, g.CacheStats().Items, len(keys))
+	}
+	for _, k := range keys {
+		view, err := g.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(view.ByteSlice(), value) || view.Len() != len(value) {
+			t.Fatalf("got %d bytes for %s, want %d", view.Len(), k, len(value))
+		}
+	}
+}
+
+func TestGroup_CompressionChargesLoaded(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"Tom","score":630}`), 100)
+	// 解压后的value最多同时存放两个
+	g := newGroup(NewNode(), "blobs", int64(3*len(value)), RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return value, nil
+		}), WithCompression(Zstd))
+
+	keys := []string{"a", "b", "c", "d"}
+	for _, k := range keys {
+		if _, err := g.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 首次命中解压后 解压结果计入容量 之后的命中不再重复计入
+	before := g.CacheStats().Bytes
+	for i := 0; i < 2; i++ {
+		if _, err := g.Get("a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := g.CacheStats().Bytes - before; got != int64(len(value)) {
+		t.Fatalf("reading a charged %d bytes, want %d", got, len(value))
+	}
+
+	for _, k := range keys {
+		view, err := g.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(view.ByteSlice(), value) {
+			t.Fatalf("got %d bytes for %s, want %d", view.Len(), k, len(value))
+		}
+		if s := g.CacheStats(); s.Bytes > s.Capacity {
+			t.Fatalf("cache holds %d bytes after reading %s, capacity %d", s.Bytes, k, s.Capacity)
+		}
+	}
+	if s := g.CacheStats(); s.Evictions == 0 {
+		t.Fatalf("decompressed values should evict others, got %+v", s)
+	}
+}
+
+// brokenCompressor 压缩正常 解压总是失败 模拟损坏的value
+type brokenCompressor struct{ Compressor }
+
+func (brokenCompressor) Decompress(src []byte) ([]byte, error) {
+	return nil, errors.New("corrupted")
+}
+
+func TestGroup_CompressionDecompressOnce(t *testing.T) {
+	g := newGroup(NewNode(), "blobs", 2<<10, RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return []byte("v-" + key), nil
+		}), WithCompression(Snappy))
+	// 第一次 Get 返回从数据源加载的value 之后的 Get 命中缓存
+	if _, err := g.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	v1, err := g.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := g.Get("a")
+	if err != nil || v2.String() != "v-a" {
+		t.Fatalf("Get = %s, %v", v2, err)
+	}
+	// 同一记录的命中共享解压结果
+	if v1.z == nil || v1.z != v2.z {
+		t.Fatal("hits on the same entry should share the decompressed value")
+	}
+}
+
+func TestGroup_CompressionCorrupted(t *testing.T) {
+	loads := 0
+	g := newGroup(NewNode(), "blobs", 2<<10, RetrieverFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte("v-" + key), nil
+		}), WithCompression(brokenCompressor{Snappy}))
+	// 从数据源加载的value直接返回 不经过解压
+	if view, err := g.Get("a"); err != nil || view.String() != "v-a" {
+		t.Fatalf("Get = %s, %v", view, err)
+	}
+	// 缓存中的value无法解压 视为未命中并删除 重新从数据源加载
+	if _, _, ok := g.cache.get("a"); ok {
+		t.Fatal("corrupted value should be a miss")
+	}
+	if _, ok := g.cache.lruLocked().Peek("a"); ok {
+		t.Fatal("corrupted value should be dropped")
+	}
+	if _, err := g.Get("a"); err != nil || loads != 2 {
+		t.Fatalf("Get = %v, loads = %d, want reload", err, loads)
+	}
+}
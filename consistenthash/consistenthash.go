@@ -9,6 +9,7 @@ package consistenthash
 
 import (
 	"hash/crc32"
+	"hash/fnv"
 	"sort"
 	"strconv"
 )
@@ -22,11 +23,14 @@ type Consistency struct {
 	replicas int            // 虚拟节点个数(防止数据倾斜)
 	ring     []int          // uint32哈希环
 	hashmap  map[int]string // hashValue -> peerName
+	peers    map[string]bool
+	version  uint64         // 由 Register 在peers变化时计算
 }
 
 // Register 将各个peer注册到哈希环上
 func (c *Consistency) Register(peersName ...string) {
 	for _, peerName := range peersName {
+		c.peers[peerName] = true
 		for i := 0; i < c.replicas; i++ {
 			hashValue := int(c.hash([]byte(strconv.Itoa(i)+peerName)))
 			c.ring = append(c.ring, hashValue)
@@ -34,6 +38,7 @@ func (c *Consistency) Register(peersName ...string) {
 		}
 	}
 	sort.Ints(c.ring)
+	c.version = c.computeVersion()
 }
 
 // GetPeer 计算key应缓存到的peer
@@ -48,11 +53,38 @@ func (c *Consistency) GetPeer(key string) string {
 	return c.hashmap[c.ring[idx%len(c.ring)]]
 }
 
+// Version 返回哈希环的版本
+// 版本只由peer集合与虚拟节点个数决定 与注册顺序无关
+// 因此拥有相同peers的节点会得到相同的版本 空环的版本为0
+func (c *Consistency) Version() uint64 {
+	return c.version
+}
+
+// computeVersion 对排序后的peers计算哈希 Version 在每个请求上都会被调用 因此只在注册时计算
+func (c *Consistency) computeVersion() uint64 {
+	if len(c.peers) == 0 {
+		return 0
+	}
+	peers := make([]string, 0, len(c.peers))
+	for peer := range c.peers {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	h := fnv.New64a()
+	h.Write([]byte(strconv.Itoa(c.replicas)))
+	for _, peer := range peers {
+		h.Write([]byte{0})
+		h.Write([]byte(peer))
+	}
+	return h.Sum64()
+}
+
 func New(replicas int, fn HashFunc) *Consistency {
 	c := &Consistency{
 		replicas: replicas,
 		hash:     fn,
 		hashmap:  make(map[int]string),
+		peers:    make(map[string]bool),
 	}
 	if c.hash == nil {
 		c.hash = crc32.ChecksumIEEE
@@ -39,3 +39,27 @@ func TestConsistency_GetPeer(t *testing.T) {
 	peer:=c.GetPeer(key)
 	log.Printf("Go to search -> %s\n", peer)
 }
+
+func TestConsistency_Version(t *testing.T) {
+	c1 := New(2, nil)
+	c1.Register("peer1", "peer2")
+	c2 := New(2, nil)
+	c2.Register("peer2")
+	c2.Register("peer1")
+	if c1.Version() != c2.Version() {
+		t.Errorf("same peers should have the same version: %d != %d", c1.Version(), c2.Version())
+	}
+	c3 := New(2, nil)
+	c3.Register("peer1")
+	if c1.Version() == c3.Version() {
+		t.Errorf("different peers should have different versions")
+	}
+	// 再次注册后版本随之更新
+	c3.Register("peer2")
+	if c1.Version() != c3.Version() {
+		t.Errorf("version should be updated by Register: %d != %d", c1.Version(), c3.Version())
+	}
+	if v := New(2, nil).Version(); v != 0 {
+		t.Errorf("empty ring version = %d, want 0", v)
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package disk
+
+// disk 包实现了日志结构的磁盘缓存 作为内存缓存的第二层
+// 记录只追加写入到目录下的段文件中 内存中的索引记录每个key最新记录的位置
+// 总大小超过容量时删除最旧的段文件 (FIFO淘汰)
+// 每条记录带有CRC 重启时按顺序扫描段文件重建索引
+// 遇到不完整或损坏的记录(例如写入时进程崩溃)时截断该段 丢弃之后的内容
+//
+// 记录格式(小端):
+//   crc32(4) | expires(8) | keyLen(4) | valLen(4) | key | value
+// crc32覆盖crc之后的全部内容 expires为过期时间的UnixNano 0表示永不过期
+// valLen为 tombstone 时表示key已被删除 没有value
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize         = 20
+	tombstone          = ^uint32(0)
+	segmentExt         = ".seg"
+	defaultSegmentSize = 64 << 20
+)
+
+var (
+	// ErrNotFound 表示key不存在或已过期
+	ErrNotFound = errors.New("disk: key not found")
+	// ErrCorrupt 表示读取到的记录校验失败
+	ErrCorrupt = errors.New("disk: corrupt record")
+)
+
+// Store 是并发安全的磁盘缓存
+type Store struct {
+	mu          sync.RWMutex
+	dir         string
+	capacity    int64 // 所有段文件的最大总大小 0表示不限制
+	segmentSize int64 // 段文件写满segmentSize后切换到新的段
+	segments    []*segment
+	index       map[string]location
+	size        int64 // 所有段文件的总大小
+}
+
+type segment struct {
+	id   uint64
+	f    *os.File
+	size int64
+}
+
+// location 是一条记录在段文件中的位置
+type location struct {
+	seg     *segment
+	off     int64
+	size    int64 // 记录的总长度 包括header
+	expires int64
+}
+
+// Option 配置 Store 的可选项
+type Option func(*Store)
+
+// WithSegmentSize 设置段文件的大小 默认64MB
+// 淘汰以段为单位 段越小淘汰越精细 但文件数越多
+func WithSegmentSize(n int64) Option {
+	return func(s *Store) {
+		if n > 0 {
+			s.segmentSize = n
+		}
+	}
+}
+
+// Open 打开dir下的磁盘缓存 目录不存在时创建 已有的段文件将被恢复
+// capacity为段文件的最大总大小 为0时不限制
+func Open(dir string, capacity int64, opts ...Option) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:         dir,
+		capacity:    capacity,
+		segmentSize: defaultSegmentSize,
+		index:       make(map[string]location),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.recover(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover 按段的顺序扫描全部记录 重建索引
+func (s *Store) recover() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentExt), 10, 64)
+		if err != nil {
+			continue // 不是本包创建的文件
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		seg, err := s.openSegment(id)
+		if err != nil {
+			return err
+		}
+		if err := s.scan(seg); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+	}
+	s.evictLocked()
+	return nil
+}
+
+// scan 读取段中的全部记录 遇到不完整或损坏的记录时截断
+func (s *Store) scan(seg *segment) error {
+	info, err := seg.f.Stat()
+	if err != nil {
+		return err
+	}
+	var off int64
+	for off < info.Size() {
+		key, _, expires, size, deleted, err := readRecord(seg.f, off, info.Size()-off)
+		if err != nil {
+			if err := seg.f.Truncate(off); err != nil {
+				return err
+			}
+			break
+		}
+		if deleted {
+			delete(s.index, key)
+		} else {
+			s.index[key] = location{seg: seg, off: off, size: size, expires: expires}
+		}
+		off += size
+	}
+	seg.size = off
+	return nil
+}
+
+func (s *Store) openSegment(id uint64) (*segment, error) {
+	name := filepath.Join(s.dir, fmt.Sprintf("%016d%s", id, segmentExt))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{id: id, f: f}, nil
+}
+
+// readRecord 读取off处不超过limit字节的记录 deleted表示该记录是tombstone
+func readRecord(r io.ReaderAt, off, limit int64) (key string, value []byte, expires, size int64, deleted bool, err error) {
+	var header [headerSize]byte
+	if _, err = r.ReadAt(header[:], off); err != nil {
+		return
+	}
+	keyLen := binary.LittleEndian.Uint32(header[12:16])
+	valLen := binary.LittleEndian.Uint32(header[16:20])
+	n := int64(keyLen)
+	if valLen != tombstone {
+		n += int64(valLen)
+	}
+	if headerSize+n > limit {
+		// 长度字段损坏或记录未写完
+		err = ErrCorrupt
+		return
+	}
+	body := make([]byte, n)
+	if _, err = r.ReadAt(body, off+headerSize); err != nil {
+		return
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.LittleEndian.Uint32(header[0:4]) {
+		err = ErrCorrupt
+		return
+	}
+	key = string(body[:keyLen])
+	size = headerSize + n
+	if valLen == tombstone {
+		deleted = true
+		return
+	}
+	expires = int64(binary.LittleEndian.Uint64(header[4:12]))
+	value = body[keyLen:]
+	return
+}
+
+// encodeRecord 编码一条记录 del为true时编码tombstone
+func encodeRecord(key string, value []byte, expires int64, del bool) []byte {
+	n := len(key)
+	valLen := tombstone
+	if !del {
+		n += len(value)
+		valLen = uint32(len(value))
+	}
+	buf := make([]byte, headerSize+n)
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(expires))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[16:20], valLen)
+	copy(buf[headerSize:], key)
+	if !del {
+		copy(buf[headerSize+len(key):], value)
+	}
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// appendLocked 将记录追加到当前段 当前段写满时切换到新的段
+func (s *Store) appendLocked(rec []byte) (*segment, int64, error) {
+	var seg *segment
+	if n := len(s.segments); n > 0 {
+		seg = s.segments[n-1]
+	}
+	if seg == nil || seg.size > 0 && seg.size+int64(len(rec)) > s.segmentSize {
+		var id uint64
+		if seg != nil {
+			id = seg.id + 1
+		}
+		var err error
+		if seg, err = s.openSegment(id); err != nil {
+			return nil, 0, err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	off := seg.size
+	if _, err := seg.f.WriteAt(rec, off); err != nil {
+		// 写入失败的部分内容将在恢复时被截断
+		return nil, 0, err
+	}
+	seg.size += int64(len(rec))
+	s.size += int64(len(rec))
+	return seg, off, nil
+}
+
+// Put 写入key 已有的记录将被覆盖 expires为零值时永不过期
+func (s *Store) Put(key string, value []byte, expires time.Time) error {
+	var exp int64
+	if !expires.IsZero() {
+		exp = expires.UnixNano()
+	}
+	rec := encodeRecord(key, value, exp, false)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg, off, err := s.appendLocked(rec)
+	if err != nil {
+		return err
+	}
+	s.index[key] = location{seg: seg, off: off, size: int64(len(rec)), expires: exp}
+	s.evictLocked()
+	return nil
+}
+
+// Get 读取key及其过期时间 key不存在或已过期时返回 ErrNotFound
+func (s *Store) Get(key string) (value []byte, expires time.Time, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	loc, ok := s.index[key]
+	if !ok {
+		return nil, time.Time{}, ErrNotFound
+	}
+	if loc.expires != 0 {
+		expires = time.Unix(0, loc.expires)
+		if time.Now().After(expires) {
+			return nil, time.Time{}, ErrNotFound
+		}
+	}
+	k, value, _, _, _, err := readRecord(loc.seg.f, loc.off, loc.size)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if k != key {
+		return nil, time.Time{}, ErrCorrupt
+	}
+	return value, expires, nil
+}
+
+// Has 返回key是否存在且未过期
+func (s *Store) Has(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	loc, ok := s.index[key]
+	return ok && (loc.expires == 0 || time.Now().UnixNano() <= loc.expires)
+}
+
+// Delete 删除key 写入tombstone使删除在重启后仍然有效 key不存在时是no-op
+func (s *Store) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	delete(s.index, key)
+	_, _, err := s.appendLocked(encodeRecord(key, nil, 0, true))
+	if err == nil {
+		s.evictLocked()
+	}
+	return err
+}
+
+// evictLocked 删除最旧的段直到不超过容量 当前写入的段不会被删除
+func (s *Store) evictLocked() {
+	for s.capacity > 0 && s.size > s.capacity && len(s.segments) > 1 {
+		seg := s.segments[0]
+		s.segments = s.segments[1:]
+		s.size -= seg.size
+		for key, loc := range s.index {
+			if loc.seg == seg {
+				delete(s.index, key)
+			}
+		}
+		seg.f.Close()
+		os.Remove(seg.f.Name())
+	}
+}
+
+// Len 返回磁盘缓存中key的个数 包括已过期但尚未被淘汰的key
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.index)
+}
+
+// Size 返回段文件的总大小 包括已被覆盖或删除的记录
+func (s *Store) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
+
+// Sync 将段文件刷入磁盘
+func (s *Store) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, seg := range s.segments {
+		if err := seg.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 关闭所有段文件
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var first error
+	for _, seg := range s.segments {
+		if err := seg.f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	s.segments = nil
+	s.index = make(map[string]location)
+	return first
+}
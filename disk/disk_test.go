@@ -0,0 +1,156 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package disk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "peanutcache-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func mustGet(t *testing.T, s *Store, key string) []byte {
+	t.Helper()
+	value, _, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	return value
+}
+
+func TestStore_PutGetDelete(t *testing.T) {
+	s, err := Open(tempDir(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Put("a", []byte("1"), time.Time{})
+	s.Put("a", []byte("2"), time.Time{})
+	s.Put("b", []byte("3"), time.Now().Add(-time.Second))
+	if got := mustGet(t, s, "a"); string(got) != "2" {
+		t.Fatalf("a = %s, want 2", got)
+	}
+	if _, _, err := s.Get("b"); err != ErrNotFound {
+		t.Fatal("expired b should not be returned")
+	}
+	expires := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	s.Put("c", []byte("4"), expires)
+	if _, got, err := s.Get("c"); err != nil || !got.Equal(expires) {
+		t.Fatalf("c expires %v, want %v (err %v)", got, expires, err)
+	}
+	s.Delete("a")
+	if _, _, err := s.Get("a"); err != ErrNotFound {
+		t.Fatal("deleted a should not be returned")
+	}
+}
+
+func TestStore_Evict(t *testing.T) {
+	value := bytes.Repeat([]byte("x"), 100)
+	rec := int64(len(encodeRecord("k0", value, 0, false)))
+	// 每段两条记录 最多保留两个段
+	s, err := Open(tempDir(t), 4*rec, WithSegmentSize(2*rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, key := range []string{"k0", "k1", "k2", "k3", "k4"} {
+		s.Put(key, value, time.Time{})
+	}
+	if _, _, err := s.Get("k0"); err != ErrNotFound {
+		t.Fatal("k0 should be evicted with the oldest segment")
+	}
+	mustGet(t, s, "k2")
+	mustGet(t, s, "k4")
+	if s.Size() > 4*rec {
+		t.Fatalf("size %d exceeds capacity %d", s.Size(), 4*rec)
+	}
+}
+
+func TestStore_Recover(t *testing.T) {
+	dir := tempDir(t)
+	s, err := Open(dir, 0, WithSegmentSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("a", []byte("alpha"), time.Time{})
+	s.Put("b", []byte("beta"), time.Time{})
+	s.Put("c", []byte("gamma"), time.Time{})
+	s.Delete("b")
+	s.Put("d", []byte("delta"), time.Time{})
+	s.Close()
+
+	// 模拟写入最后一条记录时崩溃
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	last := names[len(names)-1]
+	info, _ := os.Stat(last)
+	if err := os.Truncate(last, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(dir, 0, WithSegmentSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGet(t, s, "a"); string(got) != "alpha" {
+		t.Fatalf("a = %s after recovery", got)
+	}
+	if got := mustGet(t, s, "c"); string(got) != "gamma" {
+		t.Fatalf("c = %s after recovery", got)
+	}
+	if _, _, err := s.Get("b"); err != ErrNotFound {
+		t.Fatal("deleted b should stay deleted after recovery")
+	}
+	if _, _, err := s.Get("d"); err != ErrNotFound {
+		t.Fatal("torn d should be dropped")
+	}
+	// 截断后可以继续写入
+	s.Put("e", []byte("epsilon"), time.Time{})
+	s.Close()
+	s, err = Open(dir, 0, WithSegmentSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := mustGet(t, s, "e"); string(got) != "epsilon" {
+		t.Fatalf("e = %s after second recovery", got)
+	}
+}
+
+func TestStore_Corrupt(t *testing.T) {
+	dir := tempDir(t)
+	s, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("a", []byte("alpha"), time.Time{})
+	s.Put("b", []byte("beta"), time.Time{})
+	s.Close()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	data, _ := ioutil.ReadFile(names[0])
+	data[len(data)-1] ^= 0xff // 破坏b的value
+	ioutil.WriteFile(names[0], data, 0644)
+
+	s, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	mustGet(t, s, "a")
+	if _, _, err := s.Get("b"); err != ErrNotFound {
+		t.Fatal("corrupt b should be dropped")
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errors 模块定义peanutcache的错误
+// peer之间通过gRPC状态码传递这些错误 调用方可以使用 errors.Is 判断错误类型
+
+var (
+	// ErrNotFound 表示数据源中不存在该key
+	// Retriever 应返回它(或用%w包装它)来表明key不存在 而不是其他错误
+	// 这样 Group 才能进行负缓存
+	ErrNotFound = errors.New("peanutcache: key not found")
+	// ErrKeyRequired 表示请求的key为空
+	ErrKeyRequired = errors.New("peanutcache: key required")
+	// ErrGroupNotFound 表示节点上不存在请求的 Group
+	ErrGroupNotFound = errors.New("peanutcache: group not found")
+	// ErrPeerUnavailable 表示无法连接peer或请求peer超时
+	ErrPeerUnavailable = errors.New("peanutcache: peer unavailable")
+	// ErrLeaseNotHeld 表示填充者不是key当前的租约持有者 例如租约已过期并发放给了其他节点
+	ErrLeaseNotHeld = errors.New("peanutcache: fill lease not held")
+)
+
+// toStatus 将错误转换为带状态码的gRPC错误 供server返回给peer
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Unknown
+	switch {
+	case errors.Is(err, ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, ErrKeyRequired):
+		code = codes.InvalidArgument
+	case errors.Is(err, ErrGroupNotFound):
+		code = codes.FailedPrecondition
+	case errors.Is(err, ErrPeerUnavailable):
+		code = codes.Unavailable
+	case errors.Is(err, ErrLeaseNotHeld):
+		code = codes.Aborted
+	}
+	return status.Error(code, err.Error())
+}
+
+// fromStatus 将peer返回的gRPC错误还原为对应的错误
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.NotFound:
+		return ErrNotFound
+	case codes.InvalidArgument:
+		return ErrKeyRequired
+	case codes.FailedPrecondition:
+		return ErrGroupNotFound
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return ErrPeerUnavailable
+	case codes.Aborted:
+		return ErrLeaseNotHeld
+	}
+	return errors.New(s.Message())
+}
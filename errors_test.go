@@ -0,0 +1,48 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrors_StatusRoundTrip(t *testing.T) {
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{fmt.Errorf("mysql: %w", ErrNotFound), codes.NotFound},
+		{ErrKeyRequired, codes.InvalidArgument},
+		{fmt.Errorf("%w: scores", ErrGroupNotFound), codes.FailedPrecondition},
+		{ErrPeerUnavailable, codes.Unavailable},
+		{fmt.Errorf("%w: scores/Tom", ErrLeaseNotHeld), codes.Aborted},
+	}
+	for _, tt := range tests {
+		st := toStatus(tt.err)
+		if status.Code(st) != tt.code {
+			t.Fatalf("%v mapped to %s, want %s", tt.err, status.Code(st), tt.code)
+		}
+		if back := fromStatus(st); !errors.Is(tt.err, back) {
+			t.Fatalf("%v mapped back to %v", tt.err, back)
+		}
+	}
+
+	if back := fromStatus(status.FromContextError(context.DeadlineExceeded).Err()); back != ErrPeerUnavailable {
+		t.Fatalf("timeout should be ErrPeerUnavailable, got %v", back)
+	}
+	other := toStatus(errors.New("mysql: connection refused"))
+	if status.Code(other) != codes.Unknown {
+		t.Fatalf("unknown error mapped to %s", status.Code(other))
+	}
+	if back := fromStatus(other); back.Error() != "mysql: connection refused" {
+		t.Fatalf("unknown error message lost: %v", back)
+	}
+}
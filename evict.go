@@ -0,0 +1,106 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+// evict 模块在记录离开 Group 的缓存时通知应用
+// 应用可以借此写入二级存储 记录审计事件或维护自己的索引
+// 回调在释放缓存的锁之后调用 因此可以在回调中访问 Group
+
+import (
+	"time"
+
+	"github.com/peanutzhen/peanutcache/lru"
+)
+
+// EvictReason 是记录离开缓存的原因
+type EvictReason int
+
+const (
+	ReasonCapacity EvictReason = iota // 超出容量(或共享预算)被淘汰
+	ReasonExpired                     // 超过hard TTL被删除
+	ReasonRemoved                     // 被 Group.Remove 删除
+	ReasonReplaced                    // 被同一key的新value替换
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case ReasonCapacity:
+		return "capacity"
+	case ReasonExpired:
+		return "expired"
+	case ReasonRemoved:
+		return "removed"
+	case ReasonReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
+// EvictFunc 处理离开缓存的记录 value为离开前缓存的值
+type EvictFunc func(key string, value ByteView, reason EvictReason)
+
+// WithOnEvict 为 Group 注册记录离开缓存时的回调 可以注册多个 按注册顺序调用
+// 回调在触发淘汰的 Get 或 Remove 返回前同步执行 耗时的处理应自行异步
+func WithOnEvict(fn EvictFunc) GroupOption {
+	return func(g *Group) {
+		g.cache.onEvict = append(g.cache.onEvict, fn)
+	}
+}
+
+// evicted 是等待通知的一次淘汰
+type evicted struct {
+	key    string
+	value  ByteView
+	hard   time.Time
+	reason EvictReason
+}
+
+// unlock 释放c.mu 并通知持有锁期间产生的淘汰
+func (c *cache) unlock() {
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+	for _, e := range pending {
+		if c.tier != nil && e.reason == ReasonCapacity {
+			c.spill(e)
+		}
+		for _, fn := range c.onEvict {
+			fn(originalKey(e.key), e.value, e.reason)
+		}
+	}
+}
+
+// notify 通知其他路径(例如 Budget 的淘汰)产生的淘汰
+func (c *cache) notify() {
+	if len(c.onEvict) == 0 && c.tier == nil {
+		return
+	}
+	c.mu.Lock()
+	c.unlock()
+}
+
+// evictedLocked 记录一次淘汰 等待释放锁后通知
+func (c *cache) evictedLocked(key string, value lru.Lengthable, reason EvictReason) {
+	if len(c.onEvict) > 0 || c.tier != nil && reason == ReasonCapacity {
+		e := value.(*entry)
+		c.pending = append(c.pending, evicted{key: key, value: e.view(), hard: e.hard, reason: reason})
+	}
+}
+
+// deleteLocked 以reason删除key 返回key是否存在
+func (c *cache) deleteLocked(key string, reason EvictReason) bool {
+	if c.lru == nil {
+		return false
+	}
+	c.reason = reason
+	defer func() { c.reason = ReasonCapacity }()
+	return c.lru.Delete(key)
+}
+
+// Remove 从本节点的缓存(包括磁盘层)中删除key 返回key是否存在
+// 不会影响其他peer 若key属于其他peer 本节点只可能缓存过它被转发前的值
+func (g *Group) Remove(key string) bool {
+	return g.cache.remove(cacheKey(key, g.gens.of(key)))
+}
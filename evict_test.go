@@ -0,0 +1,66 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroup_OnEvict(t *testing.T) {
+	var got []string
+	hook := func(key string, value ByteView, reason EvictReason) {
+		got = append(got, key+":"+reason.String()+":"+value.String())
+	}
+	node := NewNode()
+	g := node.NewGroup("evict", 0, RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte("v" + key), nil
+	}), WithOnEvict(hook), WithTTL(20*time.Millisecond, 20*time.Millisecond))
+
+	g.populateCache("a", ByteView{b: []byte("old")})
+	g.populateCache("a", ByteView{b: []byte("new")})
+	if _, err := g.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Remove("b") || g.Remove("b") {
+		t.Fatal("b should be removed exactly once")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := g.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a:replaced:old", "b:removed:vb", "a:expired:new"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if s := g.CacheStats(); s.Evictions != 0 {
+		t.Fatalf("only capacity evictions should be counted, got %d", s.Evictions)
+	}
+}
+
+func TestGroup_OnEvictCapacity(t *testing.T) {
+	var evicted []string
+	node := NewNode()
+	b := NewSharedBudget(3<<10, EvictGlobalLRU)
+	var g *Group
+	g = node.NewGroup("evict", 0, kiloRetriever(), WithBudget(b, 1),
+		WithOnEvict(func(key string, value ByteView, reason EvictReason) {
+			if reason != ReasonCapacity || value.Len() != 1<<10 {
+				t.Errorf("%s evicted for %s with %d bytes", key, reason, value.Len())
+			}
+			// 回调中可以访问 Group
+			g.CacheStats()
+			evicted = append(evicted, key)
+		}))
+	for _, key := range []string{"k0", "k1", "k2", "k3"} {
+		if _, err := g.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(evicted, []string{"k0", "k1"}) {
+		t.Fatalf("evicted %v", evicted)
+	}
+}
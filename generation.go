@@ -0,0 +1,170 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// generation 模块实现按 Group 或key前缀批量失效
+// Group 与每个前缀各有一个只增不减的代数 key的代数为 Group 的代数与key匹配的全部前缀的代数之和
+// 代数不为0时 缓存中实际使用的key会附带代数 增加代数后旧代数的记录不会再被访问
+// 它们随正常的lru淘汰被清除 因此失效不需要遍历缓存
+// key的代数随请求发送给归属节点 BumpGeneration 还会通知所有peer
+// 注意: 使用代数时key不应以"\x00"开头
+
+const genSep = "\x00"
+
+// generations 记录 Group 与各个前缀的代数
+type generations struct {
+	mu       sync.RWMutex
+	group    uint64
+	prefixes map[string]uint64
+	trie     *genNode // 按字节索引prefixes 每次 Get 都需要计算key的代数
+}
+
+// genNode 是前缀树的节点 gen为从根到该节点的前缀的代数
+type genNode struct {
+	gen      uint64
+	children map[byte]*genNode
+}
+
+// of 返回key的代数 沿key的字节遍历前缀树 耗时与key的长度成正比 与前缀的个数无关
+func (gs *generations) of(key string) uint64 {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	gen := gs.group
+	n := gs.trie
+	for i := 0; n != nil && i < len(key); i++ {
+		n = n.children[key[i]]
+		if n != nil {
+			gen += n.gen
+		}
+	}
+	return gen
+}
+
+// get 返回prefix的代数 prefix为空时返回 Group 的代数
+func (gs *generations) get(prefix string) uint64 {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	if prefix == "" {
+		return gs.group
+	}
+	return gs.prefixes[prefix]
+}
+
+// set 将prefix的代数增加到gen 返回设置后的代数 不会减小代数
+// gen为0时在当前代数上加1
+func (gs *generations) set(prefix string, gen uint64) uint64 {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	cur := gs.group
+	if prefix != "" {
+		cur = gs.prefixes[prefix]
+	}
+	if gen == 0 {
+		gen = cur + 1
+	}
+	if gen <= cur {
+		return cur
+	}
+	if prefix == "" {
+		gs.group = gen
+	} else {
+		if gs.prefixes == nil {
+			gs.prefixes = make(map[string]uint64)
+			gs.trie = &genNode{}
+		}
+		gs.prefixes[prefix] = gen
+		n := gs.trie
+		for i := 0; i < len(prefix); i++ {
+			child, ok := n.children[prefix[i]]
+			if !ok {
+				if n.children == nil {
+					n.children = make(map[byte]*genNode)
+				}
+				child = &genNode{}
+				n.children[prefix[i]] = child
+			}
+			n = child
+		}
+		n.gen = gen
+	}
+	return gen
+}
+
+// cacheKey 返回key在代数gen下缓存中实际使用的key
+func cacheKey(key string, gen uint64) string {
+	if gen == 0 {
+		return key
+	}
+	return genSep + strconv.FormatUint(gen, 36) + genSep + key
+}
+
+// originalKey 去掉 cacheKey 附加的代数
+func originalKey(ck string) string {
+	if !strings.HasPrefix(ck, genSep) {
+		return ck
+	}
+	rest := ck[len(genSep):]
+	i := strings.Index(rest, genSep)
+	if i < 0 {
+		return ck
+	}
+	if _, err := strconv.ParseUint(rest[:i], 36, 64); err != nil {
+		return ck
+	}
+	return rest[i+len(genSep):]
+}
+
+// BumpGeneration 增加prefix的代数 使所有以prefix开头的key失效 prefix为空时使整个 Group 失效
+// 本节点立即生效 并通知 Picker 中的所有peer 返回新的代数
+// 通知部分peer失败时返回错误 重试是安全的
+func (g *Group) BumpGeneration(prefix string) (uint64, error) {
+	gen := g.gens.set(prefix, 0)
+	return gen, g.broadcastGeneration(prefix, gen)
+}
+
+// Generation 返回prefix的代数 prefix为空时返回 Group 的代数
+func (g *Group) Generation(prefix string) uint64 {
+	return g.gens.get(prefix)
+}
+
+// broadcastGeneration 通知所有peer prefix的代数
+func (g *Group) broadcastGeneration(prefix string, gen uint64) error {
+	b, ok := g.picker().(broadcaster)
+	if !ok {
+		return nil
+	}
+	var failed int
+	var first error
+	for _, f := range b.peerFetchers() {
+		bm, ok := f.(bumper)
+		if !ok {
+			continue
+		}
+		if err := bm.bump(g.name, prefix, gen); err != nil {
+			failed++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("could not bump generation of %s/%s on %d peers: %w", g.name, prefix, failed, first)
+	}
+	return nil
+}
+
+// setGeneration 处理peer发来的代数 gen为0时是no-op
+func (g *Group) setGeneration(prefix string, gen uint64) {
+	if gen > 0 {
+		g.gens.set(prefix, gen)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"testing"
+)
+
+func TestCacheKey(t *testing.T) {
+	for _, key := range []string{"", "tenant/1/user", "\x00raw"} {
+		for _, gen := range []uint64{0, 1, 1 << 40} {
+			if got := originalKey(cacheKey(key, gen)); got != key {
+				t.Fatalf("originalKey(cacheKey(%q, %d)) = %q", key, gen, got)
+			}
+		}
+	}
+	if cacheKey("k", 0) != "k" {
+		t.Fatal("generation 0 should not change the key")
+	}
+}
+
+func TestGenerations_Of(t *testing.T) {
+	var gs generations
+	gs.set("", 1)
+	gs.set("tenant/1/", 2)
+	gs.set("tenant/1/user/", 3)
+	gs.set("tenant/2/", 5)
+	gs.set("t", 7)
+	tests := map[string]uint64{
+		"":                 1,
+		"x":                1,
+		"t":                8,
+		"tenant/1":         8,
+		"tenant/1/":        10,
+		"tenant/1/order/9": 10,
+		"tenant/1/user/":   13,
+		"tenant/1/user/42": 13,
+		"tenant/2/user/42": 13,
+		"tenant/3/user/42": 8,
+	}
+	for key, want := range tests {
+		if got := gs.of(key); got != want {
+			t.Fatalf("of(%q) = %d, want %d", key, got, want)
+		}
+	}
+	// 增加代数后前缀树中的代数同步更新
+	gs.set("tenant/1/", 0)
+	if got := gs.of("tenant/1/user/42"); got != 14 {
+		t.Fatalf("of after bump = %d, want 14", got)
+	}
+}
+
+func TestGroup_BumpGeneration(t *testing.T) {
+	loads := make(map[string]int)
+	node := NewNode()
+	var evicted []string
+	g := node.NewGroup("gen", 0, RetrieverFunc(func(key string) ([]byte, error) {
+		loads[key]++
+		return []byte(key), nil
+	}), WithOnEvict(func(key string, value ByteView, reason EvictReason) {
+		evicted = append(evicted, key)
+	}))
+	get := func(keys ...string) {
+		for _, key := range keys {
+			if v, err := g.Get(key); err != nil || v.String() != key {
+				t.Fatalf("get %s = %q, %v", key, v.String(), err)
+			}
+		}
+	}
+	get("tenant/a/1", "tenant/b/1")
+
+	if gen, _ := g.BumpGeneration("tenant/a/"); gen != 1 {
+		t.Fatalf("prefix generation = %d, want 1", gen)
+	}
+	get("tenant/a/1", "tenant/b/1")
+	if loads["tenant/a/1"] != 2 || loads["tenant/b/1"] != 1 {
+		t.Fatalf("only tenant/a should be reloaded, loads %v", loads)
+	}
+
+	g.BumpGeneration("")
+	get("tenant/a/1", "tenant/b/1")
+	if loads["tenant/a/1"] != 3 || loads["tenant/b/1"] != 2 {
+		t.Fatalf("group bump should reload every key, loads %v", loads)
+	}
+
+	// peer的代数不会减小本地的代数
+	g.setGeneration("tenant/a/", 1)
+	if g.Generation("tenant/a/") != 1 || g.Generation("") != 1 {
+		t.Fatalf("generations = %d, %d", g.Generation("tenant/a/"), g.Generation(""))
+	}
+	if !g.Remove("tenant/a/1") || len(evicted) != 1 || evicted[0] != "tenant/a/1" {
+		t.Fatalf("hooks should see the original key, got %v", evicted)
+	}
+}
@@ -3,6 +3,9 @@ module github.com/peanutzhen/peanutcache
 go 1.16
 
 require (
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.13.6
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	go.etcd.io/etcd/client/v3 v3.5.0
 	google.golang.org/grpc v1.38.0
 	google.golang.org/protobuf v1.27.1
@@ -0,0 +1,587 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package gossip 实现了SWIM风格的成员管理 作为不依赖etcd的服务发现方式
+//
+// 每个成员周期性地随机探测(ping)一个成员 若在超时前没有收到ack
+// 则请求若干其他成员代为探测(ping-req) 仍然失败则将其标记为suspect
+// suspect成员若未能在超时前反驳(以更高的incarnation宣告alive) 则被判定dead
+// 成员状态的变化搭载(piggyback)在ping/ack中传播 新成员通过TCP与种子节点
+// 交换全量状态加入集群
+//
+// Gossip 同时实现了 registry.Registry 因此可以直接交给server使用
+package gossip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peanutzhen/peanutcache/registry"
+)
+
+// State 表示成员的状态
+type State int
+
+const (
+	StateAlive State = iota
+	StateSuspect
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Member 描述集群中的一个成员
+type Member struct {
+	Name        string   // 成员唯一标识 默认为Addr
+	Addr        string   // gossip地址 ip:port
+	Endpoints   []string // 成员注册的服务 格式为 service/addr
+	State       State
+	Incarnation uint64 // 成员自己维护的版本号 用于反驳怀疑
+}
+
+// EventType 表示成员事件的类型
+type EventType int
+
+const (
+	EventJoin   EventType = iota // 成员加入或恢复
+	EventLeave                   // 成员离开或被判定dead
+	EventUpdate                  // 成员注册的服务发生变化
+)
+
+// Event 是成员变化事件
+type Event struct {
+	Type   EventType
+	Member Member
+}
+
+// Config 配置 Gossip
+type Config struct {
+	Name             string        // 成员名 为空时使用监听地址
+	BindAddr         string        // UDP/TCP监听地址 端口为0时随机选择
+	Seeds            []string      // 启动时加入的种子节点地址
+	ProbeInterval    time.Duration // 探测间隔 默认1s
+	ProbeTimeout     time.Duration // 等待ack的超时 默认500ms
+	IndirectChecks   int           // 间接探测的成员数 默认3
+	SuspicionTimeout time.Duration // suspect成员被判定dead的超时 默认5倍探测间隔
+	PushPullInterval time.Duration // 与随机成员交换全量状态的间隔 默认30倍探测间隔
+	RetransmitMult   int           // 每条状态变化的重传倍数 默认4
+	DeadTimeout      time.Duration // dead成员从成员表中清除前保留的时间 默认与PushPullInterval相同
+	EventBuffer      int           // Events 未被读取时最多保留的事件数 超出时丢弃最旧的事件 默认1024
+
+	// dropPacket 仅供测试 返回true时丢弃发往to的UDP消息
+	dropPacket func(to string, m *message) bool
+}
+
+func (c *Config) setDefaults() {
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = time.Second
+	}
+	if c.ProbeTimeout <= 0 {
+		c.ProbeTimeout = c.ProbeInterval / 2
+	}
+	if c.IndirectChecks <= 0 {
+		c.IndirectChecks = 3
+	}
+	if c.SuspicionTimeout <= 0 {
+		c.SuspicionTimeout = 5 * c.ProbeInterval
+	}
+	if c.PushPullInterval <= 0 {
+		c.PushPullInterval = 30 * c.ProbeInterval
+	}
+	if c.RetransmitMult <= 0 {
+		c.RetransmitMult = 4
+	}
+	if c.DeadTimeout <= 0 {
+		c.DeadTimeout = c.PushPullInterval
+	}
+	if c.EventBuffer <= 0 {
+		c.EventBuffer = 1024
+	}
+}
+
+// ErrClosed 表示 Gossip 已经关闭
+var ErrClosed = errors.New("gossip: closed")
+
+// Gossip 维护集群成员列表
+type Gossip struct {
+	config Config
+	udp    *net.UDPConn
+	tcp    net.Listener
+
+	mu         sync.Mutex
+	self       *Member
+	members    map[string]*Member     // name -> member 不包括自己
+	timers     map[string]*time.Timer // suspect成员判定dead或dead成员清除的定时器
+	broadcasts []*broadcast
+	probeOrder []string
+	seq        uint64
+	acks       map[uint64]func() // seq -> 收到ack时的回调
+	watchers   map[*watcher]struct{}
+	leaving    bool
+
+	eventMu    sync.Mutex
+	eventCond  *sync.Cond
+	eventQueue []Event
+	events     chan Event
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// New 创建 Gossip 开始监听并加入种子节点
+// 种子节点全部不可达时 New依然返回 Gossip 此时它是集群中唯一的成员
+func New(config Config) (*Gossip, error) {
+	config.setDefaults()
+	udp, tcp, err := listen(config.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	addr := udp.LocalAddr().String()
+	name := config.Name
+	if name == "" {
+		name = addr
+	}
+	g := &Gossip{
+		config: config,
+		udp:    udp,
+		tcp:    tcp,
+		self: &Member{
+			Name: name,
+			Addr: addr,
+			// 以启动时间作为初始incarnation 使重启后的成员可以覆盖旧的dead状态
+			Incarnation: uint64(time.Now().UnixNano()),
+		},
+		members:  make(map[string]*Member),
+		timers:   make(map[string]*time.Timer),
+		acks:     make(map[uint64]func()),
+		watchers: make(map[*watcher]struct{}),
+		events:   make(chan Event),
+		closed:   make(chan struct{}),
+	}
+	g.eventCond = sync.NewCond(&g.eventMu)
+
+	g.wg.Add(5)
+	go g.readPackets()
+	go g.acceptStreams()
+	go g.probeLoop()
+	go g.pushPullLoop()
+	go g.dispatchEvents()
+
+	if len(config.Seeds) > 0 {
+		if n, err := g.Join(config.Seeds...); n == 0 {
+			log.Printf("[gossip %s] failed to join seeds: %v", addr, err)
+		}
+	}
+	return g, nil
+}
+
+// Addr 返回 Gossip 的监听地址
+func (g *Gossip) Addr() string {
+	return g.self.Addr
+}
+
+// Join 与seeds交换全量状态从而加入集群 返回成功交换的种子数
+func (g *Gossip) Join(seeds ...string) (int, error) {
+	var n int
+	var lastErr error
+	for _, seed := range seeds {
+		if seed == g.self.Addr {
+			continue
+		}
+		if err := g.pushPull(seed); err != nil {
+			lastErr = err
+			continue
+		}
+		n++
+	}
+	return n, lastErr
+}
+
+// Members 返回当前未被判定dead的成员 包括自己
+func (g *Gossip) Members() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	members := []Member{copyMember(g.self)}
+	for _, m := range g.members {
+		if m.State != StateDead {
+			members = append(members, copyMember(m))
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// Events 返回成员变化事件 事件按发生顺序投递
+// 未被读取的事件最多保留 Config.EventBuffer 个 超出时丢弃最旧的事件
+func (g *Gossip) Events() <-chan Event {
+	return g.events
+}
+
+// Leave 宣告自己离开集群并关闭 Gossip
+func (g *Gossip) Leave() error {
+	g.mu.Lock()
+	if g.leaving {
+		g.mu.Unlock()
+		return nil
+	}
+	g.leaving = true
+	g.self.State = StateDead
+	g.self.Incarnation++
+	g.queueBroadcastLocked(g.self)
+	targets := g.randomMembersLocked(g.config.IndirectChecks, "")
+	g.mu.Unlock()
+
+	// 直接通知部分成员 加快离开的传播
+	for _, m := range targets {
+		g.sendPacket(m.Addr, &message{Type: msgPing, Seq: g.nextSeq()})
+	}
+	return g.Close()
+}
+
+// Close 停止 Gossip 不通知其他成员 它们将通过探测发现自己已失效
+func (g *Gossip) Close() error {
+	g.closeOnce.Do(func() {
+		close(g.closed)
+		g.udp.Close()
+		g.tcp.Close()
+		g.eventMu.Lock()
+		g.eventCond.Broadcast()
+		g.eventMu.Unlock()
+		g.mu.Lock()
+		for name, t := range g.timers {
+			t.Stop()
+			delete(g.timers, name)
+		}
+		for w := range g.watchers {
+			w.cancel()
+		}
+		g.mu.Unlock()
+		g.wg.Wait()
+	})
+	return nil
+}
+
+func (g *Gossip) isClosed() bool {
+	select {
+	case <-g.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// ---------------------- registry.Registry ----------------------
+
+// Register 将service/addr加入自己的Endpoints并传播给其他成员
+func (g *Gossip) Register(service string, addr string) error {
+	return g.updateEndpoints(func(endpoints []string) []string {
+		key := service + "/" + addr
+		for _, e := range endpoints {
+			if e == key {
+				return endpoints
+			}
+		}
+		return append(endpoints, key)
+	})
+}
+
+// Deregister 将service/addr从自己的Endpoints移除并传播给其他成员
+func (g *Gossip) Deregister(service string, addr string) error {
+	return g.updateEndpoints(func(endpoints []string) []string {
+		key := service + "/" + addr
+		kept := make([]string, 0, len(endpoints))
+		for _, e := range endpoints {
+			if e != key {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	})
+}
+
+func (g *Gossip) updateEndpoints(fn func([]string) []string) error {
+	if g.isClosed() {
+		return ErrClosed
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	endpoints := fn(append([]string(nil), g.self.Endpoints...))
+	sort.Strings(endpoints)
+	g.self.Endpoints = endpoints
+	g.self.Incarnation++
+	g.queueBroadcastLocked(g.self)
+	g.notifyWatchersLocked()
+	return nil
+}
+
+// Resolve 返回未被判定dead的成员中service下的全部地址
+func (g *Gossip) Resolve(service string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resolveLocked(service), nil
+}
+
+func (g *Gossip) resolveLocked(service string) []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	collect := func(m *Member) {
+		if m.State == StateDead {
+			return
+		}
+		for _, key := range m.Endpoints {
+			if key != service && !strings.HasPrefix(key, service+"/") {
+				continue
+			}
+			addr := key[strings.LastIndex(key, "/")+1:]
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	collect(g.self)
+	for _, m := range g.members {
+		collect(m)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// watcher 是一个 Watch 调用
+type watcher struct {
+	service string
+	ch      chan []string
+	cancel  context.CancelFunc
+}
+
+// Watch 监听service下的地址变化 成员加入/离开/更新服务时推送全量地址
+func (g *Gossip) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	if g.isClosed() {
+		return nil, ErrClosed
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watcher{service: service, ch: make(chan []string, 1), cancel: cancel}
+	g.mu.Lock()
+	g.watchers[w] = struct{}{}
+	registry.SendLatest(w.ch, g.resolveLocked(service))
+	g.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		g.mu.Lock()
+		delete(g.watchers, w)
+		close(w.ch)
+		g.mu.Unlock()
+	}()
+	return w.ch, nil
+}
+
+func (g *Gossip) notifyWatchersLocked() {
+	for w := range g.watchers {
+		registry.SendLatest(w.ch, g.resolveLocked(w.service))
+	}
+}
+
+// ---------------------- 成员状态 ----------------------
+
+// mergeLocked 按照SWIM的规则合并一条成员状态
+func (g *Gossip) mergeLocked(u Member) {
+	if u.Name == g.self.Name {
+		// 其他成员怀疑自己 以更高的incarnation反驳
+		if !g.leaving && u.State != StateAlive && u.Incarnation >= g.self.Incarnation {
+			g.self.Incarnation = u.Incarnation + 1
+			g.queueBroadcastLocked(g.self)
+		}
+		return
+	}
+	cur, known := g.members[u.Name]
+	switch u.State {
+	case StateAlive:
+		if known && u.Incarnation <= cur.Incarnation {
+			return
+		}
+		wasAlive := known && cur.State != StateDead
+		changed := !known || !equalStrings(cur.Endpoints, u.Endpoints)
+		m := copyMember(&u)
+		g.members[u.Name] = &m
+		g.stopSuspicionLocked(u.Name)
+		g.queueBroadcastLocked(&m)
+		if !wasAlive {
+			g.emitLocked(EventJoin, &m)
+		} else if changed {
+			g.emitLocked(EventUpdate, &m)
+		}
+	case StateSuspect:
+		if !known || cur.State == StateDead || u.Incarnation < cur.Incarnation {
+			return
+		}
+		if cur.State == StateSuspect && u.Incarnation == cur.Incarnation {
+			return
+		}
+		cur.State, cur.Incarnation = StateSuspect, u.Incarnation
+		g.startSuspicionLocked(cur.Name, cur.Incarnation)
+		g.queueBroadcastLocked(cur)
+	case StateDead:
+		if !known {
+			// 记录dead状态 避免旧的alive消息使其复活
+			m := copyMember(&u)
+			g.members[u.Name] = &m
+			g.startReapLocked(u.Name, u.Incarnation)
+			return
+		}
+		if cur.State == StateDead || u.Incarnation < cur.Incarnation {
+			return
+		}
+		cur.State, cur.Incarnation = StateDead, u.Incarnation
+		g.startReapLocked(cur.Name, cur.Incarnation)
+		g.queueBroadcastLocked(cur)
+		g.emitLocked(EventLeave, cur)
+	}
+}
+
+// suspectLocked 将探测失败的成员标记为suspect
+func (g *Gossip) suspectLocked(name string) {
+	if m, ok := g.members[name]; ok && m.State == StateAlive {
+		log.Printf("[gossip %s] suspect %s", g.self.Addr, name)
+		u := copyMember(m)
+		u.State = StateSuspect
+		g.mergeLocked(u)
+	}
+}
+
+func (g *Gossip) startSuspicionLocked(name string, incarnation uint64) {
+	g.stopSuspicionLocked(name)
+	g.timers[name] = time.AfterFunc(g.config.SuspicionTimeout, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		m, ok := g.members[name]
+		if !ok || m.State != StateSuspect || m.Incarnation != incarnation {
+			return
+		}
+		log.Printf("[gossip %s] %s is dead", g.self.Addr, name)
+		u := copyMember(m)
+		u.State = StateDead
+		g.mergeLocked(u)
+	})
+}
+
+// startReapLocked 在DeadTimeout后将dead成员从成员表中清除
+// 此时关于它的旧消息已停止传播 不会再使其复活 成员表不会随成员更替无限增长
+func (g *Gossip) startReapLocked(name string, incarnation uint64) {
+	g.stopSuspicionLocked(name)
+	g.timers[name] = time.AfterFunc(g.config.DeadTimeout, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		m, ok := g.members[name]
+		if !ok || m.State != StateDead || m.Incarnation != incarnation {
+			return
+		}
+		delete(g.members, name)
+		delete(g.timers, name)
+	})
+}
+
+// stopSuspicionLocked 停止name的定时器 成员恢复alive时调用
+func (g *Gossip) stopSuspicionLocked(name string) {
+	if t, ok := g.timers[name]; ok {
+		t.Stop()
+		delete(g.timers, name)
+	}
+}
+
+// emitLocked 投递事件并通知 Watch
+func (g *Gossip) emitLocked(typ EventType, m *Member) {
+	g.notifyWatchersLocked()
+	g.eventMu.Lock()
+	if len(g.eventQueue) >= g.config.EventBuffer {
+		// 没有人读取 Events 时不能无限堆积
+		g.eventQueue = g.eventQueue[1:]
+	}
+	g.eventQueue = append(g.eventQueue, Event{Type: typ, Member: copyMember(m)})
+	g.eventCond.Signal()
+	g.eventMu.Unlock()
+}
+
+// dispatchEvents 按顺序将事件写入events 不阻塞协议本身
+func (g *Gossip) dispatchEvents() {
+	defer g.wg.Done()
+	for {
+		g.eventMu.Lock()
+		for len(g.eventQueue) == 0 && !g.isClosed() {
+			g.eventCond.Wait()
+		}
+		if g.isClosed() {
+			g.eventMu.Unlock()
+			close(g.events)
+			return
+		}
+		ev := g.eventQueue[0]
+		g.eventQueue = g.eventQueue[1:]
+		g.eventMu.Unlock()
+
+		select {
+		case g.events <- ev:
+		case <-g.closed:
+			close(g.events)
+			return
+		}
+	}
+}
+
+// randomMembersLocked 随机选择至多n个未dead的成员 排除名为exclude的成员
+func (g *Gossip) randomMembersLocked(n int, exclude string) []Member {
+	var candidates []Member
+	for _, m := range g.members {
+		if m.State != StateDead && m.Name != exclude {
+			candidates = append(candidates, copyMember(m))
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+func copyMember(m *Member) Member {
+	c := *m
+	c.Endpoints = append([]string(nil), m.Endpoints...)
+	return c
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 测试Gossip是否实现了Registry接口
+var _ registry.Registry = (*Gossip)(nil)
@@ -0,0 +1,247 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package gossip
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/peanutzhen/peanutcache"
+)
+
+func testConfig(seeds ...string) Config {
+	return Config{
+		BindAddr:         "127.0.0.1:0",
+		Seeds:            seeds,
+		ProbeInterval:    50 * time.Millisecond,
+		ProbeTimeout:     20 * time.Millisecond,
+		SuspicionTimeout: 200 * time.Millisecond,
+	}
+}
+
+func newTestGossip(t *testing.T, config Config) *Gossip {
+	g, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// eventually 在timeout内反复检查cond
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGossip_Join(t *testing.T) {
+	a := newTestGossip(t, testConfig())
+	defer a.Close()
+	b := newTestGossip(t, testConfig(a.Addr()))
+	defer b.Close()
+	c := newTestGossip(t, testConfig(b.Addr()))
+	defer c.Close()
+
+	for _, g := range []*Gossip{a, b, c} {
+		g := g
+		eventually(t, 2*time.Second, func() bool { return len(g.Members()) == 3 },
+			fmt.Sprintf("%s never saw all members", g.Addr()))
+	}
+}
+
+func TestGossip_DetectFailure(t *testing.T) {
+	a := newTestGossip(t, testConfig())
+	defer a.Close()
+	b := newTestGossip(t, testConfig(a.Addr()))
+	defer b.Close()
+	c := newTestGossip(t, testConfig(a.Addr()))
+	eventually(t, 2*time.Second, func() bool { return len(a.Members()) == 3 }, "cluster never formed")
+
+	// c不辞而别 a与b需要通过探测发现
+	c.Close()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case ev := <-a.Events():
+			if ev.Type == EventLeave && ev.Member.Name == c.Addr() {
+				eventually(t, 2*time.Second, func() bool { return len(b.Members()) == 2 }, "b never removed c")
+				return
+			}
+		case <-timeout:
+			t.Fatal("a never detected c's failure")
+		}
+	}
+}
+
+func TestGossip_IndirectProbe(t *testing.T) {
+	a := newTestGossip(t, testConfig())
+	defer a.Close()
+	b := newTestGossip(t, testConfig(a.Addr()))
+	defer b.Close()
+	c := newTestGossip(t, testConfig(a.Addr()))
+	defer c.Close()
+	eventually(t, 2*time.Second, func() bool {
+		return len(a.Members()) == 3 && len(b.Members()) == 3 && len(c.Members()) == 3
+	}, "cluster never formed")
+
+	// a无法直接ping c 但b可以代为探测
+	var dropped int32
+	a.mu.Lock()
+	a.config.dropPacket = func(to string, m *message) bool {
+		if to == c.Addr() && m.Type == msgPing {
+			atomic.AddInt32(&dropped, 1)
+			return true
+		}
+		return false
+	}
+	a.mu.Unlock()
+	incarnation := c.Members()[0].Incarnation
+	for _, m := range c.Members() {
+		if m.Name == c.Addr() {
+			incarnation = m.Incarnation
+		}
+	}
+
+	time.Sleep(30 * a.config.ProbeInterval)
+	if atomic.LoadInt32(&dropped) == 0 {
+		t.Fatal("a never probed c")
+	}
+	for _, m := range a.Members() {
+		if m.Name == c.Addr() && (m.State != StateAlive || m.Incarnation != incarnation) {
+			t.Fatalf("c should never be suspected, got %s incarnation %d (was %d)", m.State, m.Incarnation, incarnation)
+		}
+	}
+}
+
+func TestGossip_Leave(t *testing.T) {
+	a := newTestGossip(t, testConfig())
+	defer a.Close()
+	b := newTestGossip(t, testConfig(a.Addr()))
+	eventually(t, 2*time.Second, func() bool { return len(a.Members()) == 2 }, "cluster never formed")
+
+	b.Leave()
+	// 主动离开无需等待suspicion超时
+	eventually(t, a.config.SuspicionTimeout, func() bool { return len(a.Members()) == 1 }, "a never saw b leave")
+}
+
+func TestGossip_ReapDeadMembers(t *testing.T) {
+	config := testConfig()
+	config.DeadTimeout = 200 * time.Millisecond
+	a := newTestGossip(t, config)
+	defer a.Close()
+	b := newTestGossip(t, testConfig(a.Addr()))
+	eventually(t, 2*time.Second, func() bool { return len(a.Members()) == 2 }, "cluster never formed")
+
+	b.Leave()
+	// dead成员在DeadTimeout后从成员表中清除
+	eventually(t, 2*time.Second, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		_, ok := a.members[b.Addr()]
+		return !ok
+	}, "a never reaped b")
+}
+
+func TestGossip_EventBuffer(t *testing.T) {
+	config := testConfig()
+	config.EventBuffer = 2
+	a := newTestGossip(t, config)
+	defer a.Close()
+	for i := 0; i < 4; i++ {
+		g := newTestGossip(t, testConfig(a.Addr()))
+		defer g.Close()
+	}
+	eventually(t, 2*time.Second, func() bool { return len(a.Members()) == 5 }, "cluster never formed")
+
+	// 没有人读取 Events 时 事件不会无限堆积
+	a.eventMu.Lock()
+	queued := len(a.eventQueue)
+	a.eventMu.Unlock()
+	if queued > config.EventBuffer {
+		t.Fatalf("%d events queued, want at most %d", queued, config.EventBuffer)
+	}
+	// 丢弃的是最旧的事件 最后一个加入的成员依然可以读取到
+	var last Event
+	for {
+		select {
+		case ev := <-a.Events():
+			last = ev
+			continue
+		case <-time.After(50 * time.Millisecond):
+		}
+		break
+	}
+	if last.Type != EventJoin {
+		t.Fatalf("last event = %+v, want a join", last)
+	}
+}
+
+// startServer 启动一个使用g作为registry并自动更新peers的cache节点
+func startServer(t *testing.T, g *Gossip, loads *int32) (*peanutcache.Node, peanutcache.Picker) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := peanutcache.NewNode()
+	node.NewGroup("scores", 2<<10, peanutcache.RetrieverFunc(
+		func(key string) ([]byte, error) {
+			atomic.AddInt32(loads, 1)
+			return []byte(key), nil
+		}))
+	svr, err := node.NewServer(lis.Addr().String(),
+		peanutcache.WithRegistry(g), peanutcache.WithPeerWatch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.RegisterPicker(svr)
+	go svr.Serve(lis)
+	return node, svr
+}
+
+func TestGossip_FeedsServerRing(t *testing.T) {
+	ga := newTestGossip(t, testConfig())
+	defer ga.Close()
+	gb := newTestGossip(t, testConfig(ga.Addr()))
+
+	var loadsA, loadsB int32
+	a, picker := startServer(t, ga, &loadsA)
+	defer a.Stop()
+	b, _ := startServer(t, gb, &loadsB)
+
+	eventually(t, 2*time.Second, func() bool {
+		addrs, _ := ga.Resolve("peanutcache")
+		return len(addrs) == 2
+	}, "a never discovered b's server")
+
+	// 两个节点的哈希环一致后 a上的key有一部分由b填充
+	eventually(t, 2*time.Second, func() bool {
+		for i := 0; i < 20; i++ {
+			if _, err := a.GetGroup("scores").Get(fmt.Sprintf("key%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return atomic.LoadInt32(&loadsB) > 0
+	}, "b never served keys owned by it")
+
+	// b离开后 a的哈希环只剩下自己
+	b.Stop()
+	gb.Leave()
+	eventually(t, 2*time.Second, func() bool {
+		for i := 0; i < 20; i++ {
+			if _, ok := picker.Pick(fmt.Sprintf("key%d", i)); ok {
+				return false
+			}
+		}
+		return true
+	}, "a still picks b after it left")
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package gossip
+
+// probe 模块实现SWIM的失效检测
+// 每个探测周期按随机顺序轮流选择一个成员ping
+// 超时未收到ack时 请求 IndirectChecks 个成员代为探测
+// 间接探测也失败时 将该成员标记为suspect
+
+import (
+	"math/rand"
+	"time"
+)
+
+func (g *Gossip) probeLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.closed:
+			return
+		case <-ticker.C:
+		}
+		g.probe()
+	}
+}
+
+// probe 完成一次探测
+func (g *Gossip) probe() {
+	target, ok := g.nextProbeTarget()
+	if !ok {
+		return
+	}
+	acked := make(chan struct{}, 1)
+	onAck := func() {
+		select {
+		case acked <- struct{}{}:
+		default:
+		}
+	}
+	seq := g.nextSeq()
+	g.mu.Lock()
+	g.acks[seq] = onAck
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.acks, seq)
+		g.mu.Unlock()
+	}()
+
+	g.sendPacket(target.Addr, &message{Type: msgPing, Seq: seq})
+	if g.waitAck(acked, g.config.ProbeTimeout) {
+		return
+	}
+
+	// 间接探测 转发回来的ack与直接探测使用同一个seq
+	g.mu.Lock()
+	helpers := g.randomMembersLocked(g.config.IndirectChecks, target.Name)
+	g.mu.Unlock()
+	for _, h := range helpers {
+		g.sendPacket(h.Addr, &message{Type: msgPingReq, Seq: seq, Target: target.Addr})
+	}
+	if g.waitAck(acked, 2*g.config.ProbeTimeout) {
+		return
+	}
+
+	g.mu.Lock()
+	g.suspectLocked(target.Name)
+	g.mu.Unlock()
+}
+
+// waitAck 等待ack 超时或关闭时返回false
+func (g *Gossip) waitAck(acked chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-acked:
+		return true
+	case <-timer.C:
+		return false
+	case <-g.closed:
+		return false
+	}
+}
+
+// nextProbeTarget 按随机顺序轮流返回未dead的成员
+// 一轮结束后重新打乱 保证每个成员在有限时间内都会被探测
+func (g *Gossip) nextProbeTarget() (Member, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for attempts := 0; attempts < 2; attempts++ {
+		for len(g.probeOrder) > 0 {
+			name := g.probeOrder[0]
+			g.probeOrder = g.probeOrder[1:]
+			if m, ok := g.members[name]; ok && m.State != StateDead {
+				return copyMember(m), true
+			}
+		}
+		for name, m := range g.members {
+			if m.State != StateDead {
+				g.probeOrder = append(g.probeOrder, name)
+			}
+		}
+		rand.Shuffle(len(g.probeOrder), func(i, j int) {
+			g.probeOrder[i], g.probeOrder[j] = g.probeOrder[j], g.probeOrder[i]
+		})
+	}
+	return Member{}, false
+}
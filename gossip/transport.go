@@ -0,0 +1,290 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package gossip
+
+// transport 模块负责成员之间的通信
+// 探测消息通过UDP发送 并搭载最近的成员状态变化
+// 全量状态交换(加入集群/反熵)通过TCP完成 UDP与TCP监听同一个端口
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	msgPing    = "ping"
+	msgPingReq = "ping-req"
+	msgAck     = "ack"
+
+	maxPacketSize = 64 << 10 // UDP消息的最大长度
+	maxPiggyback  = 8        // 每条消息最多搭载的成员状态数
+	streamTimeout = 5 * time.Second
+	listenRetries = 10
+)
+
+// message 是成员之间交换的UDP消息
+type message struct {
+	Type    string   `json:"type"`
+	Seq     uint64   `json:"seq"`
+	From    string   `json:"from"`             // 发送者的gossip地址 用于回复
+	Target  string   `json:"target,omitempty"` // ping-req中需要代为探测的地址
+	Updates []Member `json:"updates,omitempty"`
+}
+
+// broadcast 是一条等待传播的成员状态
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+// listen 在addr上同时监听UDP与TCP 端口为0时选择一个两者都可用的端口
+func listen(addr string) (*net.UDPConn, net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < listenRetries; i++ {
+		udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+		if err != nil {
+			return nil, nil, err
+		}
+		udp, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err == nil {
+			return udp, tcp, nil
+		}
+		udp.Close()
+		if port != "0" {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, fmt.Errorf("gossip: no free port on %s", host)
+}
+
+// queueBroadcastLocked 将成员状态加入待传播队列 替换同一成员的旧状态
+func (g *Gossip) queueBroadcastLocked(m *Member) {
+	kept := g.broadcasts[:0]
+	for _, b := range g.broadcasts {
+		if b.member.Name != m.Name {
+			kept = append(kept, b)
+		}
+	}
+	g.broadcasts = append(kept, &broadcast{member: copyMember(m)})
+}
+
+// piggybackLocked 取出本次消息需要搭载的成员状态
+// 每条状态至多传播 RetransmitMult*log(n+1) 次
+func (g *Gossip) piggybackLocked() []Member {
+	if len(g.broadcasts) == 0 {
+		return nil
+	}
+	limit := g.config.RetransmitMult * int(math.Ceil(math.Log10(float64(len(g.members)+2))))
+	sort.SliceStable(g.broadcasts, func(i, j int) bool {
+		return g.broadcasts[i].transmits < g.broadcasts[j].transmits
+	})
+	var updates []Member
+	for _, b := range g.broadcasts {
+		if len(updates) == maxPiggyback {
+			break
+		}
+		updates = append(updates, copyMember(&b.member))
+		b.transmits++
+	}
+	kept := g.broadcasts[:0]
+	for _, b := range g.broadcasts {
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	g.broadcasts = kept
+	return updates
+}
+
+// sendPacket 通过UDP发送消息 自动填充发送者并搭载成员状态
+func (g *Gossip) sendPacket(to string, m *message) {
+	g.mu.Lock()
+	m.From = g.self.Addr
+	m.Updates = g.piggybackLocked()
+	drop := g.config.dropPacket
+	g.mu.Unlock()
+
+	if drop != nil && drop(to, m) {
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("[gossip %s] encode message failed: %v", g.self.Addr, err)
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", to)
+	if err != nil {
+		return
+	}
+	g.udp.WriteToUDP(data, addr)
+}
+
+// readPackets 读取并处理UDP消息
+func (g *Gossip) readPackets() {
+	defer g.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := g.udp.ReadFromUDP(buf)
+		if err != nil {
+			if g.isClosed() {
+				return
+			}
+			continue
+		}
+		var m message
+		if err := json.Unmarshal(buf[:n], &m); err != nil {
+			continue
+		}
+		g.handlePacket(&m)
+	}
+}
+
+func (g *Gossip) handlePacket(m *message) {
+	g.mu.Lock()
+	for _, u := range m.Updates {
+		g.mergeLocked(u)
+	}
+	g.mu.Unlock()
+
+	switch m.Type {
+	case msgPing:
+		g.sendPacket(m.From, &message{Type: msgAck, Seq: m.Seq})
+	case msgPingReq:
+		// 代为探测Target 收到ack后转发给请求者
+		requester, seq := m.From, m.Seq
+		g.probeAddr(m.Target, func() {
+			g.sendPacket(requester, &message{Type: msgAck, Seq: seq})
+		})
+	case msgAck:
+		g.mu.Lock()
+		fn, ok := g.acks[m.Seq]
+		delete(g.acks, m.Seq)
+		g.mu.Unlock()
+		if ok {
+			fn()
+		}
+	}
+}
+
+// probeAddr 向addr发送ping 在 ProbeTimeout 内收到ack时调用onAck
+func (g *Gossip) probeAddr(addr string, onAck func()) {
+	seq := g.nextSeq()
+	g.mu.Lock()
+	g.acks[seq] = onAck
+	g.mu.Unlock()
+	time.AfterFunc(g.config.ProbeTimeout, func() {
+		g.mu.Lock()
+		delete(g.acks, seq)
+		g.mu.Unlock()
+	})
+	g.sendPacket(addr, &message{Type: msgPing, Seq: seq})
+}
+
+func (g *Gossip) nextSeq() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.seq++
+	return g.seq
+}
+
+// ---------------------- 全量状态交换 ----------------------
+
+// acceptStreams 处理其他成员发起的TCP全量状态交换
+func (g *Gossip) acceptStreams() {
+	defer g.wg.Done()
+	for {
+		conn, err := g.tcp.Accept()
+		if err != nil {
+			if g.isClosed() {
+				return
+			}
+			continue
+		}
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(streamTimeout))
+			var remote []Member
+			if err := json.NewDecoder(conn).Decode(&remote); err != nil {
+				return
+			}
+			if err := json.NewEncoder(conn).Encode(g.localState()); err != nil {
+				return
+			}
+			g.mergeState(remote)
+		}()
+	}
+}
+
+// pushPull 通过TCP与addr交换全量状态
+func (g *Gossip) pushPull(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, streamTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(streamTimeout))
+	if err := json.NewEncoder(conn).Encode(g.localState()); err != nil {
+		return err
+	}
+	var remote []Member
+	if err := json.NewDecoder(conn).Decode(&remote); err != nil {
+		return err
+	}
+	g.mergeState(remote)
+	return nil
+}
+
+// localState 返回包括自己在内的全部成员状态
+func (g *Gossip) localState() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state := []Member{copyMember(g.self)}
+	for _, m := range g.members {
+		state = append(state, copyMember(m))
+	}
+	return state
+}
+
+func (g *Gossip) mergeState(state []Member) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, m := range state {
+		g.mergeLocked(m)
+	}
+}
+
+// pushPullLoop 周期性地与随机成员交换全量状态 修复丢失的传播
+func (g *Gossip) pushPullLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.config.PushPullInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.closed:
+			return
+		case <-ticker.C:
+		}
+		g.mu.Lock()
+		targets := g.randomMembersLocked(1, "")
+		g.mu.Unlock()
+		if len(targets) == 1 {
+			g.pushPull(targets[0].Addr)
+		}
+	}
+}
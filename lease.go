@@ -0,0 +1,202 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// lease 模块实现集群范围的singleflight
+// singlefilght.Flight 只能在进程内去重 当peer故障导致多个节点同时从本地填充时
+// 它们会同时访问数据源 启用 WithFillLease 后 key的归属节点为每个key发放填充租约
+// 只有持有租约的节点访问数据源 并通过Fill将值交给归属节点
+// 其他节点轮询归属节点 直到取得值或租约过期后自己获得租约
+
+const (
+	leasePollInterval = 10 * time.Millisecond
+	localHolder       = "" // 归属节点自身从本地填充时使用的持有者
+)
+
+// leaser 由能够向归属节点申请租约的 Fetcher 实现
+type leaser interface {
+	// lease 申请填充key的租约 found为true时value为归属节点已缓存的值
+	lease(group, key string) (value []byte, found, granted bool, err error)
+	// fill 将从数据源获取的值交给归属节点 并释放租约
+	fill(group, key string, value []byte) error
+	// release 在从数据源获取失败时释放租约 其他节点无需等待租约过期
+	release(group, key string) error
+}
+
+// leaseTable 记录每个key的租约 由key的归属节点维护
+// 持有者故障时租约不会被释放 过期的租约在发放或检查租约时清理
+type leaseTable struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	leases map[string]fillLease
+	swept  time.Time // 上次清理全部过期租约的时间
+}
+
+type fillLease struct {
+	holder  string
+	expires time.Time
+}
+
+func newLeaseTable(ttl time.Duration) *leaseTable {
+	return &leaseTable{ttl: ttl, leases: make(map[string]fillLease)}
+}
+
+// grant 尝试将key的租约发放给holder 租约未过期的持有者再次申请时续期
+func (t *leaseTable) grant(key, holder string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.sweep(now)
+	if l, ok := t.leases[key]; ok && l.holder != holder && now.Before(l.expires) {
+		return false
+	}
+	t.leases[key] = fillLease{holder: holder, expires: now.Add(t.ttl)}
+	return true
+}
+
+// sweep 删除全部过期的租约 每个ttl最多清理一次 调用方需持有t.mu
+func (t *leaseTable) sweep(now time.Time) {
+	if now.Sub(t.swept) < t.ttl {
+		return
+	}
+	for key, l := range t.leases {
+		if !now.Before(l.expires) {
+			delete(t.leases, key)
+		}
+	}
+	t.swept = now
+}
+
+// held 判断holder是否持有key未过期的租约 过期的租约被删除
+func (t *leaseTable) held(key, holder string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.leases[key]
+	if !ok {
+		return false
+	}
+	if !time.Now().Before(l.expires) {
+		delete(t.leases, key)
+		return false
+	}
+	return l.holder == holder
+}
+
+// release 释放holder持有的租约
+func (t *leaseTable) release(key, holder string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l, ok := t.leases[key]; ok && l.holder == holder {
+		delete(t.leases, key)
+	}
+}
+
+// WithFillLease 为 Group 启用集群范围的填充租约 ttl为租约的有效期
+// 应大于 Retriever 的耗时 持有者故障时其他节点最多等待ttl
+// 集群中所有节点的同名 Group 应使用相同的设置
+func WithFillLease(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.lease = newLeaseTable(ttl)
+	}
+}
+
+// loadWithLease 在从归属节点获取失败后 通过租约决定由谁访问数据源
+// 无法向归属节点申请租约时退化为直接从本地获取
+// 租约以key申请 归属节点按自己的代数处理 ck只用于本地填充
+func (g *Group) loadWithLease(key, ck string, l leaser) (ByteView, error) {
+	deadline := time.Now().Add(2 * g.lease.ttl)
+	for time.Now().Before(deadline) {
+		value, found, granted, err := l.lease(g.name, key)
+		if err != nil {
+			log.Printf("fail to lease *%s* from peer, %s.\n", key, err.Error())
+			break
+		}
+		if found {
+			g.Stats.PeerLoads.Add(1)
+			// value来自刚反序列化的响应 由 Group 持有 不需要复制
+			return ByteView{b: value}, nil
+		}
+		if granted {
+			view, err := g.getLocally(key, ck)
+			if err != nil {
+				// 释放租约 等待中的节点可以立即重试 而不是等待租约过期
+				if err := l.release(g.name, key); err != nil {
+					log.Printf("fail to release lease of *%s* on peer, %s.\n", key, err.Error())
+				}
+				return view, err
+			}
+			if err := l.fill(g.name, key, view.ByteSlice()); err != nil {
+				log.Printf("fail to fill *%s* to peer, %s.\n", key, err.Error())
+			}
+			return view, nil
+		}
+		g.Stats.LeaseWaits.Add(1)
+		time.Sleep(leasePollInterval)
+	}
+	return g.getLocally(key, ck)
+}
+
+// acquireLocalLease 由归属节点在从本地填充ck前调用
+// 若其他节点正持有租约 则等待其填充 返回填充的值与true
+// 否则获得租约 返回false 调用方填充后需要释放租约
+func (g *Group) acquireLocalLease(ck string) (ByteView, bool) {
+	deadline := time.Now().Add(2 * g.lease.ttl)
+	for !g.lease.grant(ck, localHolder) {
+		if value, _, ok := g.cache.get(ck); ok {
+			return value, true
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		g.Stats.LeaseWaits.Add(1)
+		time.Sleep(leasePollInterval)
+	}
+	return ByteView{}, false
+}
+
+// leaseFor 处理peer的租约申请 使用本节点计算的代数
+func (g *Group) leaseFor(key, holder string) (value ByteView, found, granted bool) {
+	ck := cacheKey(key, g.gens.of(key))
+	if value, stale, ok := g.cache.get(ck); ok && !stale {
+		return value, true, false
+	}
+	if g.lease == nil {
+		// 未启用租约时不做协调
+		return ByteView{}, false, true
+	}
+	return ByteView{}, false, g.lease.grant(ck, holder)
+}
+
+// fillFrom 接收租约持有者填充的值
+// 启用租约时只接受当前持有者的填充 租约过期后迟到的填充可能覆盖新持有者的值 返回 ErrLeaseNotHeld
+// value来自刚反序列化的请求 由 Group 持有 不需要复制
+func (g *Group) fillFrom(key, holder string, value []byte) error {
+	ck := cacheKey(key, g.gens.of(key))
+	if g.lease == nil {
+		g.populateCache(ck, ByteView{b: value})
+		return nil
+	}
+	if !g.lease.held(ck, holder) {
+		return fmt.Errorf("%w: %s/%s by %s", ErrLeaseNotHeld, g.name, key, holder)
+	}
+	// 先填充再释放租约 等待者轮询时不会在两者之间获得租约
+	g.populateCache(ck, ByteView{b: value})
+	g.lease.release(ck, holder)
+	return nil
+}
+
+// releaseFrom 释放holder持有的租约 不填充value
+func (g *Group) releaseFrom(key, holder string) {
+	if g.lease != nil {
+		g.lease.release(cacheKey(key, g.gens.of(key)), holder)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGroup_FillFromHolder(t *testing.T) {
+	g := newGroup(NewNode(), "scores", 2<<10, RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte("630"), nil
+	}), WithFillLease(time.Second))
+
+	// 未获得租约的节点不能填充
+	if err := g.fillFrom("Tom", "10.0.0.2:6324", []byte("stale")); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Fatalf("fill without lease = %v, want ErrLeaseNotHeld", err)
+	}
+	if _, found, granted := g.leaseFor("Tom", "10.0.0.1:6324"); found || !granted {
+		t.Fatalf("lease should be granted, found=%v granted=%v", found, granted)
+	}
+	if _, _, granted := g.leaseFor("Tom", "10.0.0.2:6324"); granted {
+		t.Fatal("lease should not be granted twice")
+	}
+	if err := g.fillFrom("Tom", "10.0.0.2:6324", []byte("stale")); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Fatalf("fill by other node = %v, want ErrLeaseNotHeld", err)
+	}
+	if _, _, ok := g.cache.get("Tom"); ok {
+		t.Fatal("rejected fill should not populate the cache")
+	}
+	if err := g.fillFrom("Tom", "10.0.0.1:6324", []byte("630")); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, _ := g.leaseFor("Tom", "10.0.0.2:6324"); !found || value.String() != "630" {
+		t.Fatalf("filled value = %s, found=%v", value, found)
+	}
+}
+
+func TestGroup_ReleaseFrom(t *testing.T) {
+	g := newGroup(NewNode(), "scores", 2<<10, RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte("630"), nil
+	}), WithFillLease(time.Minute))
+
+	g.leaseFor("Tom", "10.0.0.1:6324")
+	// 只有持有者能释放租约
+	g.releaseFrom("Tom", "10.0.0.2:6324")
+	if _, _, granted := g.leaseFor("Tom", "10.0.0.2:6324"); granted {
+		t.Fatal("lease released by a non-holder")
+	}
+	g.releaseFrom("Tom", "10.0.0.1:6324")
+	if _, _, granted := g.leaseFor("Tom", "10.0.0.2:6324"); !granted {
+		t.Fatal("released lease should be granted to the next node")
+	}
+}
+
+func TestLeaseTable_DropExpired(t *testing.T) {
+	table := newLeaseTable(20 * time.Millisecond)
+	// 持有者故障 租约既没有被释放也没有被填充
+	for _, key := range []string{"Tom", "Jack", "Sam"} {
+		if !table.grant(key, "10.0.0.1:6324") {
+			t.Fatalf("lease of %s should be granted", key)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// 检查过期的租约时将其删除
+	if table.held("Tom", "10.0.0.1:6324") {
+		t.Fatal("expired lease should not be held")
+	}
+	if _, ok := table.leases["Tom"]; ok {
+		t.Fatal("expired lease should be dropped when checked")
+	}
+	// 发放租约时清理其他过期的租约
+	if !table.grant("Ann", "10.0.0.2:6324") {
+		t.Fatal("lease of Ann should be granted")
+	}
+	if len(table.leases) != 1 {
+		t.Fatalf("%d leases left, want only Ann", len(table.leases))
+	}
+}
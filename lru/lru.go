@@ -11,8 +11,23 @@ package lru
 
 import (
 	"container/list"
+	"unsafe"
 )
 
+// mapSlotOverhead 是哈希表中每个key占用的槽位大小的估计
+// 包括string header(16) 元素指针(8) tophash(1) 以及装载因子(6.5/8)带来的空闲槽位
+const mapSlotOverhead = 32
+
+// EntryOverhead 是每条记录在 len(key)+value.Len() 之外占用的内存
+// 包括链表节点 记录本身以及哈希表中的槽位
+// 不包括value自身结构体的大小 这部分应由 Lengthable.Len 计入
+var EntryOverhead = int64(unsafe.Sizeof(list.Element{})) + int64(unsafe.Sizeof(Value{})) + mapSlotOverhead
+
+// entrySize 返回一条记录实际占用的内存
+func entrySize(key string, value Lengthable) int64 {
+	return int64(len(key)) + int64(value.Len()) + EntryOverhead
+}
+
 // Lengthable 接口指明对象可以获取自身占有内存空间大小 以字节为单位
 type Lengthable interface {
 	Len() int
@@ -22,6 +37,7 @@ type Lengthable interface {
 type Value struct {
 	key   string
 	value Lengthable
+	size  int64 // 记录加入或 Resize 时计入 length 的大小
 }
 
 // OnEliminated 当key-value被淘汰时 执行的处理函数
@@ -60,24 +76,95 @@ func (c *Cache) Get(key string) (value Lengthable, ok bool) {
 	return
 }
 
-func (c *Cache) Add(key string, value Lengthable) {
-	kvSize := int64(len(key)) + int64(value.Len())
-	// cache 容量检查
-	for c.capacity != 0 && c.length+kvSize > c.capacity {
-		c.Remove()
+// Peek 返回key对应的value 但不改变其位置
+func (c *Cache) Peek(key string) (value Lengthable, ok bool) {
+	if elem, ok := c.hashmap[key]; ok {
+		return elem.Value.(*Value).value, true
 	}
+	return
+}
+
+// Add 添加或更新key 超出容量时淘汰最久未使用的记录
+// 刚添加的记录位于最前 因此只有在其他记录都被淘汰后才会被淘汰
+// 单条记录(包括 EntryOverhead)超过容量时 其他记录全部被淘汰后它自身也会被淘汰
+// 并对它调用淘汰回调 即Add返回后缓存中不存在key
+// 更新已存在的key时不会对旧value调用回调 但新value变大时同样可能淘汰其他记录或它自身
+func (c *Cache) Add(key string, value Lengthable) {
 	if elem, ok := c.hashmap[key]; ok {
 		// 更新缓存key值
 		c.doublyLinkedList.MoveToFront(elem)
 		oldEntry := elem.Value.(*Value)
 		// 先更新写入字节 再更新
-		c.length += int64(value.Len()) - int64(oldEntry.value.Len())
-		oldEntry.value = value
+		size := entrySize(key, value)
+		c.length += size - oldEntry.size
+		oldEntry.value, oldEntry.size = value, size
 	} else {
 		// 新增缓存key
-		elem := c.doublyLinkedList.PushFront(&Value{key: key, value: value})
+		size := entrySize(key, value)
+		elem := c.doublyLinkedList.PushFront(&Value{key: key, value: value, size: size})
 		c.hashmap[key] = elem
-		c.length += kvSize
+		c.length += size
+	}
+	c.evict()
+}
+
+// Resize 在key对应的value的 Len 发生变化后重新计算其占用的内存 返回key是否存在
+// 不改变记录的位置 变大后超出容量时同样会淘汰记录 包括它自身
+// value的 Len 只应在调用 Resize 前后变化 否则 Size 与淘汰时扣除的大小不一致
+func (c *Cache) Resize(key string) bool {
+	elem, ok := c.hashmap[key]
+	if !ok {
+		return false
+	}
+	entry := elem.Value.(*Value)
+	size := entrySize(key, entry.value)
+	c.length += size - entry.size
+	entry.size = size
+	c.evict()
+	return true
+}
+
+// SetCapacity 修改缓存的最大容量 超出新容量的记录将被淘汰
+func (c *Cache) SetCapacity(maxBytes int64) {
+	c.capacity = maxBytes
+	c.evict()
+}
+
+// Len 返回缓存中记录的条数
+func (c *Cache) Len() int {
+	return c.doublyLinkedList.Len()
+}
+
+// Oldest 返回最久未使用的记录 但不改变其位置
+func (c *Cache) Oldest() (key string, value Lengthable, ok bool) {
+	tailElem := c.doublyLinkedList.Back()
+	if tailElem == nil {
+		return
+	}
+	entry := tailElem.Value.(*Value)
+	return entry.key, entry.value, true
+}
+
+// Range 从最近使用到最久未使用依次对每条记录调用fn 不改变记录的位置
+// fn返回false时停止 fn中不能修改缓存
+func (c *Cache) Range(fn func(key string, value Lengthable) bool) {
+	for elem := c.doublyLinkedList.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*Value)
+		if !fn(entry.key, entry.value) {
+			return
+		}
+	}
+}
+
+// Size 返回缓存当前占用的内存(Byte) 包括每条记录的 EntryOverhead
+func (c *Cache) Size() int64 {
+	return c.length
+}
+
+// evict 淘汰记录直到不超过容量
+func (c *Cache) evict() {
+	for c.capacity != 0 && c.length > c.capacity && c.doublyLinkedList.Len() > 0 {
+		c.Remove()
 	}
 }
 
@@ -85,14 +172,27 @@ func (c *Cache) Add(key string, value Lengthable) {
 func (c *Cache) Remove() {
 	tailElem := c.doublyLinkedList.Back()
 	if tailElem != nil {
-		entry := tailElem.Value.(*Value)
-		k, v := entry.key, entry.value
-		delete(c.hashmap, k)                       // 移除映射
-		c.doublyLinkedList.Remove(tailElem)        // 移除缓存
-		c.length -= int64(len(k)) + int64(v.Len()) // 更新占用内存情况
-		// 移除后的善后处理
-		if c.callback != nil {
-			c.callback(k, v)
-		}
+		c.removeElement(tailElem)
+	}
+}
+
+// Delete 删除指定key的缓存 返回key是否存在
+func (c *Cache) Delete(key string) bool {
+	elem, ok := c.hashmap[key]
+	if ok {
+		c.removeElement(elem)
+	}
+	return ok
+}
+
+func (c *Cache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*Value)
+	k, v := entry.key, entry.value
+	delete(c.hashmap, k)            // 移除映射
+	c.doublyLinkedList.Remove(elem) // 移除缓存
+	c.length -= entry.size          // 更新占用内存情况
+	// 移除后的善后处理
+	if c.callback != nil {
+		c.callback(k, v)
 	}
 }
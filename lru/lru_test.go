@@ -23,3 +23,158 @@ func TestCache_Get(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCache_Delete(t *testing.T) {
+	var eliminated []string
+	cache := New(0, func(key string, value Lengthable) {
+		eliminated = append(eliminated, key)
+	})
+	cache.Add("zls", Integer(21))
+	cache.Add("peanut", Integer(22))
+	if !cache.Delete("zls") || cache.Delete("zls") {
+		t.Fatal("zls should be deleted exactly once")
+	}
+	if _, ok := cache.Get("zls"); ok {
+		t.Fatal("zls should be gone")
+	}
+	if _, ok := cache.Get("peanut"); !ok {
+		t.Fatal("peanut should remain")
+	}
+	if cache.length != int64(len("peanut"))+4+EntryOverhead {
+		t.Fatalf("length = %d after delete", cache.length)
+	}
+	if !reflect.DeepEqual(eliminated, []string{"zls"}) {
+		t.Fatalf("callback got %v", eliminated)
+	}
+}
+
+func TestCache_Overhead(t *testing.T) {
+	// 容量只够存放两条记录(含overhead)
+	entry := int64(len("k0")) + 4 + EntryOverhead
+	cache := New(2*entry, nil)
+	for _, k := range []string{"k0", "k1", "k2"} {
+		cache.Add(k, Integer(1))
+	}
+	if _, ok := cache.Get("k0"); ok {
+		t.Fatal("k0 should be evicted once overhead is counted")
+	}
+	if cache.Size() != 2*entry {
+		t.Fatalf("size = %d, want %d", cache.Size(), 2*entry)
+	}
+
+	// 缩小容量时淘汰最久未使用的记录
+	cache.Get("k1")
+	cache.SetCapacity(entry)
+	if _, ok := cache.Get("k2"); ok {
+		t.Fatal("k2 should be evicted after shrinking")
+	}
+	if _, ok := cache.Get("k1"); !ok {
+		t.Fatal("k1 should remain")
+	}
+
+	// 超过容量的单条记录不会被保留
+	cache.Add("huge", Integer(1))
+	cache.SetCapacity(1)
+	if cache.Size() != 0 {
+		t.Fatalf("size = %d, want 0", cache.Size())
+	}
+}
+
+// Blob 是长度可变的value
+type Blob []byte
+
+func (b Blob) Len() int {
+	return len(b)
+}
+
+func TestCache_AddOversized(t *testing.T) {
+	var eliminated []string
+	entry := int64(len("k0")) + 4 + EntryOverhead
+	cache := New(2*entry, func(key string, value Lengthable) {
+		eliminated = append(eliminated, key)
+	})
+	cache.Add("k0", Integer(1))
+	cache.Add("k1", Integer(1))
+
+	// 超过容量的记录先淘汰其他全部记录 最后淘汰它自身
+	cache.Add("huge", make(Blob, 2*entry))
+	if !reflect.DeepEqual(eliminated, []string{"k0", "k1", "huge"}) {
+		t.Fatalf("callback got %v", eliminated)
+	}
+	if _, ok := cache.Get("huge"); ok || cache.Len() != 0 || cache.Size() != 0 {
+		t.Fatalf("oversized entry should not be kept, len = %d size = %d", cache.Len(), cache.Size())
+	}
+
+	// 更新为超过容量的value时 回调只收到新value
+	eliminated = nil
+	cache.Add("k0", Integer(1))
+	cache.Add("k0", make(Blob, 2*entry))
+	if !reflect.DeepEqual(eliminated, []string{"k0"}) {
+		t.Fatalf("callback got %v", eliminated)
+	}
+	if cache.Len() != 0 || cache.Size() != 0 {
+		t.Fatalf("len = %d size = %d, want empty", cache.Len(), cache.Size())
+	}
+}
+
+// growing 的 Len 可以在加入缓存后改变
+type growing struct {
+	n *int
+}
+
+func (g growing) Len() int {
+	return *g.n
+}
+
+func TestCache_Resize(t *testing.T) {
+	var eliminated []string
+	entry := int64(len("k0")) + 4 + EntryOverhead
+	cache := New(3*entry, func(key string, value Lengthable) {
+		eliminated = append(eliminated, key)
+	})
+	n := 4
+	cache.Add("k0", Integer(1))
+	cache.Add("k1", growing{n: &n})
+	if cache.Resize("missing") {
+		t.Fatal("resize of a missing key should report false")
+	}
+
+	// Len 变化后 Resize 之前仍按加入时的大小计算
+	n = int(entry) + 4
+	if cache.Size() != 2*entry {
+		t.Fatalf("size = %d, want %d before resize", cache.Size(), 2*entry)
+	}
+	if !cache.Resize("k1") || cache.Size() != 3*entry {
+		t.Fatalf("size = %d, want %d after resize", cache.Size(), 3*entry)
+	}
+
+	// 超出容量时淘汰最久未使用的记录 删除时扣除的是 Resize 后的大小
+	n += int(entry)
+	cache.Resize("k1")
+	if !reflect.DeepEqual(eliminated, []string{"k0"}) {
+		t.Fatalf("callback got %v", eliminated)
+	}
+	cache.Delete("k1")
+	if cache.Len() != 0 || cache.Size() != 0 {
+		t.Fatalf("len = %d size = %d, want empty", cache.Len(), cache.Size())
+	}
+}
+
+func TestCache_Range(t *testing.T) {
+	cache := New(0, nil)
+	for _, k := range []string{"k0", "k1", "k2"} {
+		cache.Add(k, Integer(1))
+	}
+	cache.Get("k0")
+	var keys []string
+	cache.Range(func(key string, value Lengthable) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	if !reflect.DeepEqual(keys, []string{"k0", "k2"}) {
+		t.Fatalf("range visited %v", keys)
+	}
+	if key, _, _ := cache.Oldest(); key != "k1" {
+		t.Fatalf("range should not change order, oldest is %s", key)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/peanutzhen/peanutcache/lru"
+)
+
+// negative 模块缓存数据源中不存在的key
+// 避免对不存在key的请求每次都访问数据源(缓存穿透)
+// 负缓存与正常缓存分开 拥有自己的容量与较短的TTL
+
+type negativeCache struct {
+	mu  sync.Mutex
+	lru *lru.Cache
+	ttl time.Duration
+}
+
+// missing 是负缓存中的记录 只保存过期时间
+type missing time.Time
+
+func (missing) Len() int {
+	return 8
+}
+
+func newNegativeCache(maxBytes int64, ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		lru: lru.New(maxBytes, nil),
+		ttl: ttl,
+	}
+}
+
+// add 记录key不存在
+func (c *negativeCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Add(key, missing(time.Now().Add(c.ttl)))
+}
+
+// has 判断key是否已知不存在 过期的记录视为未知
+func (c *negativeCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.lru.Get(key)
+	return ok && time.Now().Before(time.Time(v.(missing)))
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"log"
+	"sync"
+)
+
+// node 模块定义一个逻辑上的缓存节点
+// 节点拥有自己的 Group 命名空间、server 以及 Picker
+// 这样同一个进程内可以运行多个相互隔离的节点 方便测试以及多租户部署
+
+// Node 管理属于它的所有 Group 以及为其服务的 server/Picker
+type Node struct {
+	mu     sync.RWMutex // 管理读写groups并发控制
+	groups map[string]*Group
+	server *server
+	picker Picker
+}
+
+// defaultNode 是包级函数(NewGroup/GetGroup/...)所使用的节点
+var defaultNode = NewNode()
+
+// NewNode 创建一个空节点
+func NewNode() *Node {
+	return &Node{groups: make(map[string]*Group)}
+}
+
+// NewGroup 在节点内创建一个新的缓存空间 同名的旧缓存空间将被覆盖
+func (n *Node) NewGroup(name string, maxBytes int64, retriever Retriever, opts ...GroupOption) *Group {
+	if retriever == nil {
+		panic("Group retriever must be existed!")
+	}
+	g := newGroup(n, name, maxBytes, retriever, opts...)
+	n.mu.Lock()
+	old := n.groups[name]
+	n.groups[name] = g
+	n.mu.Unlock()
+	if old != nil {
+		old.cache.close()
+	}
+	return g
+}
+
+// GetGroup 获取节点内对应命名空间的缓存
+func (n *Node) GetGroup(name string) *Group {
+	n.mu.RLock()
+	g := n.groups[name]
+	n.mu.RUnlock()
+	return g
+}
+
+// DestroyGroup 从节点移除对应命名空间的缓存
+// 只注销该 Group 节点的server依然为其他 Group 提供服务
+func (n *Node) DestroyGroup(name string) {
+	n.mu.Lock()
+	g, ok := n.groups[name]
+	if ok {
+		delete(n.groups, name)
+	}
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+	g.cache.close()
+	log.Printf("Destroy cache [%s]", name)
+}
+
+// NewServer 创建为节点服务的svr 若addr为空 则使用defaultAddr
+// 节点同一时刻只拥有一个server 再次调用将替换旧的server
+func (n *Node) NewServer(addr string, opts ...ServerOption) (*server, error) {
+	svr, err := newServer(n, addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	n.server = svr
+	n.mu.Unlock()
+	return svr, nil
+}
+
+// RegisterPicker 为节点设置默认的 Picker
+// 未单独注册server的 Group 将使用它选择peer
+func (n *Node) RegisterPicker(p Picker) {
+	n.mu.Lock()
+	n.picker = p
+	n.mu.Unlock()
+}
+
+// getPicker 返回节点默认的 Picker 可能为nil
+func (n *Node) getPicker() Picker {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.picker
+}
+
+// Stop 停止节点的server 如果没有server 这将是一个no-op
+func (n *Node) Stop() {
+	n.mu.RLock()
+	svr := n.server
+	n.mu.RUnlock()
+	if svr != nil {
+		svr.Stop()
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"testing"
+)
+
+func TestNode_Isolation(t *testing.T) {
+	n1, n2 := NewNode(), NewNode()
+	g1 := n1.NewGroup("scores", 2<<10, RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return []byte("n1"), nil
+		}))
+	g2 := n2.NewGroup("scores", 2<<10, RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return []byte("n2"), nil
+		}))
+
+	if n1.GetGroup("scores") != g1 || n2.GetGroup("scores") != g2 {
+		t.Fatal("nodes should own their groups independently")
+	}
+	if GetGroup("scores") == g1 || GetGroup("scores") == g2 {
+		t.Fatal("default node should not see groups of other nodes")
+	}
+	if view, err := g1.Get("Tom"); err != nil || view.String() != "n1" {
+		t.Fatalf("n1 Tom = %v, %v", view, err)
+	}
+	if view, err := g2.Get("Tom"); err != nil || view.String() != "n2" {
+		t.Fatalf("n2 Tom = %v, %v", view, err)
+	}
+
+	n1.DestroyGroup("scores")
+	if n1.GetGroup("scores") != nil {
+		t.Fatal("group should be destroyed")
+	}
+	if n2.GetGroup("scores") != g2 {
+		t.Fatal("destroying a group of n1 should not affect n2")
+	}
+}
@@ -5,19 +5,17 @@
 package peanutcache
 
 import (
-	"fmt"
+	"errors"
+	"github.com/peanutzhen/peanutcache/bloom"
 	"github.com/peanutzhen/peanutcache/singlefilght"
 	"log"
 	"sync"
+	"time"
 )
 
 // peanutcache 模块提供比cache模块更高一层抽象的能力
 // 换句话说，实现了填充缓存/命名划分缓存的能力
-
-var (
-	mu     sync.RWMutex // 管理读写groups并发控制
-	groups = make(map[string]*Group)
-)
+// 包级函数均作用于默认节点 defaultNode
 
 // Retriever 要求对象实现从数据源获取数据的能力
 type Retriever interface {
@@ -34,80 +32,207 @@ func (f RetrieverFunc) retrieve(key string) ([]byte, error) {
 
 // Group 提供命名管理缓存/填充缓存的能力
 type Group struct {
+	mu        sync.RWMutex // 保护peers
+	node      *Node
 	name      string
 	cache     *cache
 	retriever Retriever
-	server    Picker
+	peers     Picker // 为空时使用节点的默认 Picker
 	flight    *singlefilght.Flight
+	// localFlight 用于只从本地填充的加载(来自peer的转发请求)
+	// 与 flight 分开 避免转发请求加入一个正在转发给其他peer的加载
+	localFlight *singlefilght.Flight
+	negative    *negativeCache // 为空时不缓存不存在的key
+	filter      *bloom.Filter  // 已存在的key 为空时不过滤
+	lease       *leaseTable    // 为空时不使用集群范围的填充租约
+	batcher     *batcher       // retriever为 BatchRetriever 时合并并发的加载
+	refreshMu   sync.Mutex
+	refreshing  map[string]bool // 正在后台刷新的key
+	gens        generations     // Group 与key前缀的代数
+	Stats       Stats
+}
+
+// GroupOption 配置 Group 的可选项
+type GroupOption func(*Group)
+
+// WithCompression 让 Group 以c压缩后的形式缓存value lru按压缩后的大小计算容量
+// value在被访问时才解压 peer之间获取该 Group 的value时也会使用c压缩传输
+func WithCompression(c Compressor) GroupOption {
+	return func(g *Group) {
+		g.cache.codec = c
+	}
+}
+
+// WithNegativeCache 让 Group 缓存 Retriever 返回 ErrNotFound 的key
+// 在ttl内再次请求这些key将直接返回 ErrNotFound 而不访问数据源
+// 负缓存最多占用maxBytes字节 与 Group 本身的容量分开计算
+func WithNegativeCache(maxBytes int64, ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.negative = newNegativeCache(maxBytes, ttl)
+	}
 }
 
-// NewGroup 创建一个新的缓存空间
-func NewGroup(name string, maxBytes int64, retriever Retriever) *Group {
-	if retriever == nil {
-		panic("Group retriever must be existed!")
+// WithBloomFilter 让 Group 在加载前用f过滤key
+// f中一定不存在的key将直接返回 ErrNotFound 不会访问peer或数据源
+// 应用需要通过 Group.AddKeys 或 f.Add 维护数据源中已存在的key
+// 并可以通过 f.MarshalBinary 保存过滤器 重启后恢复
+func WithBloomFilter(f *bloom.Filter) GroupOption {
+	return func(g *Group) {
+		g.filter = f
 	}
+}
+
+// WithTTL 为 Group 的缓存设置soft TTL与hard TTL
+// 超过soft TTL后 Get 立即返回过时的value 并在后台刷新(同一key的刷新与加载会被合并)
+// 刷新失败时(例如数据源不可用)继续返回过时的value 直到超过hard TTL后删除
+// hard小于soft时视为与soft相同 即没有返回过时value的窗口
+func WithTTL(soft, hard time.Duration) GroupOption {
+	return func(g *Group) {
+		if hard < soft {
+			hard = soft
+		}
+		g.cache.softTTL = soft
+		g.cache.hardTTL = hard
+	}
+}
+
+// NewGroup 在默认节点创建一个新的缓存空间
+func NewGroup(name string, maxBytes int64, retriever Retriever, opts ...GroupOption) *Group {
+	return defaultNode.NewGroup(name, maxBytes, retriever, opts...)
+}
+
+func newGroup(node *Node, name string, maxBytes int64, retriever Retriever, opts ...GroupOption) *Group {
 	g := &Group{
-		name:      name,
-		cache:     newCache(maxBytes),
-		retriever: retriever,
-		flight:    &singlefilght.Flight{},
-	}
-	mu.Lock()
-	groups[name] = g
-	mu.Unlock()
+		node:        node,
+		name:        name,
+		cache:       newCache(maxBytes),
+		retriever:   retriever,
+		flight:      &singlefilght.Flight{},
+		localFlight: &singlefilght.Flight{},
+		refreshing:  make(map[string]bool),
+	}
+	if br, ok := retriever.(BatchRetriever); ok {
+		g.batcher = newBatcher(br, &g.Stats)
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
 	return g
 }
 
-// RegisterSvr 为 Group 注册 Server
+// RegisterPicker 为 Group 注册选择peer的 Picker 再次注册将替换旧的 Picker
+// 不同的 Group 可以使用不同的 Picker 例如 NoPeerPicker 或只包含部分peer的 Picker
+func (g *Group) RegisterPicker(p Picker) {
+	g.mu.Lock()
+	g.peers = p
+	g.mu.Unlock()
+}
+
+// RegisterSvr 为 Group 注册 Server 等价于 RegisterPicker
 func (g *Group) RegisterSvr(p Picker) {
-	if g.server != nil {
-		panic("group had been registered server")
-	}
-	g.server = p
+	g.RegisterPicker(p)
 }
 
-// GetGroup 获取对应命名空间的缓存
+// GetGroup 获取默认节点对应命名空间的缓存
 func GetGroup(name string) *Group {
-	mu.RLock()
-	g := groups[name]
-	mu.RUnlock()
-	return g
+	return defaultNode.GetGroup(name)
 }
 
+// DestroyGroup 销毁默认节点对应命名空间的缓存
 func DestroyGroup(name string) {
-	g := GetGroup(name)
-	if g != nil {
-		svr := g.server.(*server)
-		svr.Stop()
-		delete(groups, name)
-		log.Printf("Destroy cache [%s %s]", name, svr.addr)
+	defaultNode.DestroyGroup(name)
+}
+
+// picker 返回 Group 选择peer所用的 Picker
+// 优先使用 Group 单独注册的 Picker 其次使用节点的默认 Picker
+func (g *Group) picker() Picker {
+	g.mu.RLock()
+	peers := g.peers
+	g.mu.RUnlock()
+	if peers != nil {
+		return peers
+	}
+	if g.node != nil {
+		return g.node.getPicker()
 	}
+	return nil
 }
 
 func (g *Group) Get(key string) (ByteView, error) {
+	return g.get(key, 0, true)
+}
+
+// get 获取key对应的缓存值 forward为false时不会转发给peer 只从本地填充
+// gen为请求方计算的key的代数 使用它与本节点计算的代数中较大者
+func (g *Group) get(key string, gen uint64, forward bool) (ByteView, error) {
+	g.Stats.Gets.Add(1)
 	if key == "" {
-		return ByteView{}, fmt.Errorf("key required")
+		return ByteView{}, ErrKeyRequired
+	}
+	if local := g.gens.of(key); local > gen {
+		gen = local
 	}
-	if value, ok := g.cache.get(key); ok {
+	ck := cacheKey(key, gen)
+	if value, stale, ok := g.cache.get(ck); ok {
 		log.Println("cache hit")
+		g.Stats.CacheHits.Add(1)
+		if stale {
+			g.Stats.StaleHits.Add(1)
+			g.refresh(key, ck, gen, forward)
+		}
 		return value, nil
 	}
+	if value, ok := g.cache.getTier(ck); ok {
+		g.Stats.DiskHits.Add(1)
+		return value, nil
+	}
+	if g.filter != nil && !g.filter.Test(key) {
+		g.Stats.FilterRejects.Add(1)
+		return ByteView{}, ErrNotFound
+	}
+	if g.negative != nil && g.negative.has(ck) {
+		g.Stats.NegativeHits.Add(1)
+		return ByteView{}, ErrNotFound
+	}
 	// cache missing, get it another way
-	return g.load(key)
+	g.Stats.Loads.Add(1)
+	if !forward {
+		return g.loadLocally(key, ck)
+	}
+	return g.load(key, ck, gen)
 }
 
-func (g *Group) load(key string) (ByteView, error) {
-	view, err := g.flight.Fly(key, func() (interface{}, error) {
-		if g.server != nil {
-			if fetcher, ok := g.server.Pick(key); ok {
-				bytes, err := fetcher.Fetch(g.name, key)
+// load 从peer或本地加载key ck为key在代数gen下缓存中实际使用的key
+func (g *Group) load(key, ck string, gen uint64) (ByteView, error) {
+	view, err := g.flight.Fly(ck, func() (interface{}, error) {
+		g.Stats.LoadsDeduped.Add(1)
+		if picker := g.picker(); picker != nil {
+			if fetcher, ok := picker.Pick(key); ok {
+				bytes, err := fetch(fetcher, g.name, key, gen)
 				if err == nil {
-					return ByteView{b: cloneBytes(bytes)}, nil
+					g.Stats.PeerLoads.Add(1)
+					// value来自刚反序列化的响应 由 Group 持有 不需要复制
+					return ByteView{b: bytes}, nil
 				}
+				// peer已确认key不存在 无需再访问本地数据源
+				if errors.Is(err, ErrNotFound) {
+					g.Stats.PeerLoads.Add(1)
+					g.addMissing(ck)
+					return nil, err
+				}
+				g.Stats.PeerErrors.Add(1)
 				log.Printf("fail to get *%s* from peer, %s.\n", key, err.Error())
+				// 只有peer无法提供服务时才从本地获取
+				// 其他错误(例如peer的数据源出错)直接返回 避免重复访问数据源
+				if !fallback(err) {
+					return nil, err
+				}
+				if l, ok := fetcher.(leaser); ok && g.lease != nil {
+					return g.loadWithLease(key, ck, l)
+				}
 			}
 		}
-		return g.getLocally(key)
+		return g.getLocally(key, ck)
 	})
 	if err == nil {
 		return view.(ByteView), err
@@ -115,17 +240,110 @@ func (g *Group) load(key string) (ByteView, error) {
 	return ByteView{}, err
 }
 
-// getLocally 本地向Retriever取回数据并填充缓存
-func (g *Group) getLocally(key string) (ByteView, error) {
-	bytes, err := g.retriever.retrieve(key)
+// refresh 在后台重新加载过时的key 同一key同时只有一个刷新
+// 刷新与其他对该key的加载共享同一次flight
+func (g *Group) refresh(key, ck string, gen uint64, forward bool) {
+	g.refreshMu.Lock()
+	if g.refreshing[ck] {
+		g.refreshMu.Unlock()
+		return
+	}
+	g.refreshing[ck] = true
+	g.refreshMu.Unlock()
+
+	go func() {
+		defer func() {
+			g.refreshMu.Lock()
+			delete(g.refreshing, ck)
+			g.refreshMu.Unlock()
+		}()
+		var err error
+		if forward {
+			_, err = g.load(key, ck, gen)
+		} else {
+			_, err = g.loadLocally(key, ck)
+		}
+		if err != nil {
+			g.Stats.RefreshErrs.Add(1)
+			log.Printf("refresh *%s* failed, serving stale value: %v", key, err)
+		}
+	}()
+}
+
+// fallback 判断从peer获取失败后是否应从本地数据源获取
+func fallback(err error) bool {
+	return errors.Is(err, ErrPeerUnavailable) || errors.Is(err, ErrGroupNotFound)
+}
+
+// loadLocally 处理已被转发过的请求 无论哈希环如何都只从本地填充
+// 若本节点的哈希环认为key属于其他peer 说明哈希环不一致 记为一次bounce
+func (g *Group) loadLocally(key, ck string) (ByteView, error) {
+	if picker := g.picker(); picker != nil {
+		if _, ok := picker.Pick(key); ok {
+			g.Stats.Bounces.Add(1)
+		}
+	}
+	view, err := g.localFlight.Fly(ck, func() (interface{}, error) {
+		g.Stats.LoadsDeduped.Add(1)
+		return g.getLocally(key, ck)
+	})
+	if err == nil {
+		return view.(ByteView), err
+	}
+	return ByteView{}, err
+}
+
+// getLocally 本地向Retriever取回数据并以ck填充缓存
+func (g *Group) getLocally(key, ck string) (ByteView, error) {
+	if g.lease != nil {
+		if value, ok := g.acquireLocalLease(ck); ok {
+			return value, nil
+		}
+		defer g.lease.release(ck, localHolder)
+	}
+	bytes, err := g.retrieve(key)
+	if errors.Is(err, ErrNotFound) {
+		g.Stats.LocalLoads.Add(1)
+		g.addMissing(ck)
+		return ByteView{}, err
+	}
 	if err != nil {
+		g.Stats.LocalLoadErrs.Add(1)
 		return ByteView{}, err
 	}
+	g.Stats.LocalLoads.Add(1)
 	value := ByteView{b: cloneBytes(bytes)}
-	g.populateCache(key, value)
+	g.populateCache(ck, value)
 	return value, nil
 }
 
+// CacheStats 返回 Group 缓存的使用情况
+func (g *Group) CacheStats() CacheStats {
+	return g.cache.stats()
+}
+
+// AddKeys 将数据源中新增的key加入布隆过滤器 未启用布隆过滤器时是no-op
+func (g *Group) AddKeys(keys ...string) {
+	if g.filter != nil {
+		g.filter.Add(keys...)
+	}
+}
+
+// addMissing 在启用负缓存时记录key不存在 key为缓存中实际使用的key
+func (g *Group) addMissing(key string) {
+	if g.negative != nil {
+		g.negative.add(key)
+	}
+}
+
+// retrieve 从数据源获取key 使用 BatchRetriever 时与并发的加载合并
+func (g *Group) retrieve(key string) ([]byte, error) {
+	if g.batcher != nil {
+		return g.batcher.retrieve(key)
+	}
+	return g.retriever.retrieve(key)
+}
+
 // populateCache 提供填充缓存的能力
 func (g *Group) populateCache(key string, value ByteView) {
 	g.cache.add(key, value)
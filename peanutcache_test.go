@@ -5,9 +5,15 @@
 package peanutcache
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/peanutzhen/peanutcache/bloom"
 )
 
 func TestGet(t *testing.T) {
@@ -46,3 +52,128 @@ func TestGet(t *testing.T) {
 		log.Println(err)
 	}
 }
+
+func TestGroup_NegativeCache(t *testing.T) {
+	loads := 0
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		loads++
+		return nil, fmt.Errorf("mysql: %s: %w", key, ErrNotFound)
+	})
+
+	g := newGroup(NewNode(), "scores", 2<<10, retriever, WithNegativeCache(1<<10, 50*time.Millisecond))
+	for i := 0; i < 3; i++ {
+		if _, err := g.Get("unknown"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("want ErrNotFound, got %v", err)
+		}
+	}
+	if loads != 1 || g.Stats.NegativeHits.Get() != 2 {
+		t.Fatalf("loads = %d, negative hits = %d", loads, g.Stats.NegativeHits.Get())
+	}
+	// 过期后重新访问数据源
+	time.Sleep(60 * time.Millisecond)
+	g.Get("unknown")
+	if loads != 2 {
+		t.Fatalf("expired miss should be retrieved again, loads = %d", loads)
+	}
+
+	// 未开启负缓存时每次都访问数据源
+	loads = 0
+	g = newGroup(NewNode(), "scores", 2<<10, retriever)
+	g.Get("unknown")
+	g.Get("unknown")
+	if loads != 2 {
+		t.Fatalf("loads = %d without negative cache, want 2", loads)
+	}
+}
+
+func TestGroup_BloomFilter(t *testing.T) {
+	loads := 0
+	f := bloom.New(100, 0.01)
+	f.Add("Tom")
+	g := newGroup(NewNode(), "scores", 2<<10, RetrieverFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte(key), nil
+		}), WithBloomFilter(f))
+
+	if _, err := g.Get("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get("Jack"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound for unknown key, got %v", err)
+	}
+	if loads != 1 || g.Stats.FilterRejects.Get() != 1 {
+		t.Fatalf("loads = %d, rejects = %d", loads, g.Stats.FilterRejects.Get())
+	}
+
+	// 数据源新增key后更新过滤器
+	g.AddKeys("Jack")
+	if view, err := g.Get("Jack"); err != nil || view.String() != "Jack" {
+		t.Fatalf("Jack should be loaded after AddKeys, got %v", err)
+	}
+}
+
+func TestGroup_StaleWhileRevalidate(t *testing.T) {
+	var mu sync.Mutex
+	version, loads := 0, 0
+	var dbErr error
+	release := make(chan struct{}, 10)
+	g := newGroup(NewNode(), "scores", 2<<10, RetrieverFunc(
+		func(key string) ([]byte, error) {
+			mu.Lock()
+			loads++
+			version++
+			v, err := version, dbErr
+			mu.Unlock()
+			if v > 1 {
+				<-release // 阻塞后台刷新 验证Get不会等待它
+			}
+			return []byte(strconv.Itoa(v)), err
+		}), WithTTL(30*time.Millisecond, 200*time.Millisecond))
+
+	if view, _ := g.Get("Tom"); view.String() != "1" {
+		t.Fatalf("got %s, want 1", view)
+	}
+	time.Sleep(40 * time.Millisecond)
+	// 过时后立即返回旧值 并发的请求只触发一次刷新
+	for i := 0; i < 10; i++ {
+		if view, err := g.Get("Tom"); err != nil || view.String() != "1" {
+			t.Fatalf("stale read got %s, %v", view, err)
+		}
+	}
+	release <- struct{}{}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if view, _ := g.Get("Tom"); view.String() == "2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("value never refreshed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	if loads != 2 {
+		t.Fatalf("loads = %d, want 2", loads)
+	}
+	// 数据源故障时 在hard TTL内继续返回旧值
+	dbErr = errors.New("mysql: connection refused")
+	mu.Unlock()
+	time.Sleep(40 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		release <- struct{}{}
+		if view, err := g.Get("Tom"); err != nil || view.String() != "2" {
+			t.Fatalf("stale read during outage got %s, %v", view, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 超过hard TTL后不再返回旧值
+	time.Sleep(200 * time.Millisecond)
+	release <- struct{}{}
+	if _, err := g.Get("Tom"); err == nil {
+		t.Fatal("value past hard TTL should not be served")
+	}
+	if g.Stats.StaleHits.Get() == 0 || g.Stats.RefreshErrs.Get() == 0 {
+		t.Fatalf("stale hits = %d, refresh errors = %d", g.Stats.StaleHits.Get(), g.Stats.RefreshErrs.Get())
+	}
+}
@@ -19,6 +19,15 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type PeanutCacheClient interface {
 	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// GetStream 将value分段返回 用于超过gRPC消息大小限制的value
+	GetStream(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (PeanutCache_GetStreamClient, error)
+	// Lease 与 Fill 实现集群范围的singleflight 同一时刻只有一个节点访问数据源
+	Lease(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*LeaseResponse, error)
+	Fill(ctx context.Context, in *FillRequest, opts ...grpc.CallOption) (*FillResponse, error)
+	// Bump 使一个group或key前缀的缓存批量失效
+	Bump(ctx context.Context, in *BumpRequest, opts ...grpc.CallOption) (*BumpResponse, error)
+	// Scan 只列出节点本地缓存的记录 不会再转发给其他peer
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ScanResponse, error)
 }
 
 type peanutCacheClient struct {
@@ -38,11 +47,88 @@ func (c *peanutCacheClient) Get(ctx context.Context, in *GetRequest, opts ...grp
 	return out, nil
 }
 
+func (c *peanutCacheClient) GetStream(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (PeanutCache_GetStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PeanutCache_ServiceDesc.Streams[0], "/peanutcachepb.PeanutCache/GetStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &peanutCacheGetStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PeanutCache_GetStreamClient interface {
+	Recv() (*GetChunk, error)
+	grpc.ClientStream
+}
+
+type peanutCacheGetStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *peanutCacheGetStreamClient) Recv() (*GetChunk, error) {
+	m := new(GetChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *peanutCacheClient) Lease(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*LeaseResponse, error) {
+	out := new(LeaseResponse)
+	err := c.cc.Invoke(ctx, "/peanutcachepb.PeanutCache/Lease", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *peanutCacheClient) Fill(ctx context.Context, in *FillRequest, opts ...grpc.CallOption) (*FillResponse, error) {
+	out := new(FillResponse)
+	err := c.cc.Invoke(ctx, "/peanutcachepb.PeanutCache/Fill", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *peanutCacheClient) Bump(ctx context.Context, in *BumpRequest, opts ...grpc.CallOption) (*BumpResponse, error) {
+	out := new(BumpResponse)
+	err := c.cc.Invoke(ctx, "/peanutcachepb.PeanutCache/Bump", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *peanutCacheClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ScanResponse, error) {
+	out := new(ScanResponse)
+	err := c.cc.Invoke(ctx, "/peanutcachepb.PeanutCache/Scan", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // PeanutCacheServer is the server API for PeanutCache service.
 // All implementations must embed UnimplementedPeanutCacheServer
 // for forward compatibility
 type PeanutCacheServer interface {
 	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// GetStream 将value分段返回 用于超过gRPC消息大小限制的value
+	GetStream(*GetRequest, PeanutCache_GetStreamServer) error
+	// Lease 与 Fill 实现集群范围的singleflight 同一时刻只有一个节点访问数据源
+	Lease(context.Context, *LeaseRequest) (*LeaseResponse, error)
+	Fill(context.Context, *FillRequest) (*FillResponse, error)
+	// Bump 使一个group或key前缀的缓存批量失效
+	Bump(context.Context, *BumpRequest) (*BumpResponse, error)
+	// Scan 只列出节点本地缓存的记录 不会再转发给其他peer
+	Scan(context.Context, *ScanRequest) (*ScanResponse, error)
 	mustEmbedUnimplementedPeanutCacheServer()
 }
 
@@ -53,6 +139,21 @@ type UnimplementedPeanutCacheServer struct {
 func (UnimplementedPeanutCacheServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
 }
+func (UnimplementedPeanutCacheServer) GetStream(*GetRequest, PeanutCache_GetStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetStream not implemented")
+}
+func (UnimplementedPeanutCacheServer) Lease(context.Context, *LeaseRequest) (*LeaseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Lease not implemented")
+}
+func (UnimplementedPeanutCacheServer) Fill(context.Context, *FillRequest) (*FillResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Fill not implemented")
+}
+func (UnimplementedPeanutCacheServer) Bump(context.Context, *BumpRequest) (*BumpResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Bump not implemented")
+}
+func (UnimplementedPeanutCacheServer) Scan(context.Context, *ScanRequest) (*ScanResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
 func (UnimplementedPeanutCacheServer) mustEmbedUnimplementedPeanutCacheServer() {}
 
 // UnsafePeanutCacheServer may be embedded to opt out of forward compatibility for this service.
@@ -84,6 +185,99 @@ func _PeanutCache_Get_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _PeanutCache_GetStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PeanutCacheServer).GetStream(m, &peanutCacheGetStreamServer{stream})
+}
+
+type PeanutCache_GetStreamServer interface {
+	Send(*GetChunk) error
+	grpc.ServerStream
+}
+
+type peanutCacheGetStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *peanutCacheGetStreamServer) Send(m *GetChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _PeanutCache_Lease_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeanutCacheServer).Lease(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/peanutcachepb.PeanutCache/Lease",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeanutCacheServer).Lease(ctx, req.(*LeaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PeanutCache_Fill_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FillRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeanutCacheServer).Fill(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/peanutcachepb.PeanutCache/Fill",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeanutCacheServer).Fill(ctx, req.(*FillRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PeanutCache_Bump_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BumpRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeanutCacheServer).Bump(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/peanutcachepb.PeanutCache/Bump",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeanutCacheServer).Bump(ctx, req.(*BumpRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PeanutCache_Scan_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ScanRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeanutCacheServer).Scan(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/peanutcachepb.PeanutCache/Scan",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeanutCacheServer).Scan(ctx, req.(*ScanRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // PeanutCache_ServiceDesc is the grpc.ServiceDesc for PeanutCache service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -95,7 +289,29 @@ var PeanutCache_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Get",
 			Handler:    _PeanutCache_Get_Handler,
 		},
+		{
+			MethodName: "Lease",
+			Handler:    _PeanutCache_Lease_Handler,
+		},
+		{
+			MethodName: "Fill",
+			Handler:    _PeanutCache_Fill_Handler,
+		},
+		{
+			MethodName: "Bump",
+			Handler:    _PeanutCache_Bump_Handler,
+		},
+		{
+			MethodName: "Scan",
+			Handler:    _PeanutCache_Scan_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetStream",
+			Handler:       _PeanutCache_GetStream_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "peanutcachepb/peanutcache.proto",
 }
@@ -0,0 +1,352 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package peanutcachetest 提供在单个进程内运行多节点peanutcache集群的测试工具
+// 节点之间通过 bufconn 在内存中通信 服务发现由内存中的 Registry 完成
+// 因此分布式路径的测试无需etcd以及真实端口
+package peanutcachetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peanutzhen/peanutcache"
+	pb "github.com/peanutzhen/peanutcache/peanutcachepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	serviceName = "peanutcache"
+	basePort    = 7000
+	waitTimeout = 5 * time.Second
+)
+
+// Cluster 是运行在内存中的peanutcache集群
+type Cluster struct {
+	Registry *Registry
+	Nodes    []*peanutcache.Node
+	Addrs    []string // Addrs[i] 是 Nodes[i] 的地址
+
+	t       testing.TB
+	servers []server
+	stopped []chan error  // 第i个节点的Serve返回后收到其错误
+	exited  chan struct{} // 任意节点的Serve返回时收到通知
+	mu      sync.Mutex
+	served  map[string][]int // group/key -> 通过RPC提供该key的节点序号
+	killed  map[int]bool
+	failed  map[int]bool // 拒绝Get请求的节点
+}
+
+// server 是节点server在测试中用到的方法
+type server interface {
+	SetPeers(peersAddr ...string)
+	RingVersion() uint64
+}
+
+// Option 配置 Cluster 的可选项
+type Option func(*options)
+
+type options struct {
+	noPeers    bool
+	peerWatch  bool
+	serverOpts []peanutcache.ServerOption
+}
+
+// WithoutPeers 让节点以no-peer模式运行 只从本地填充缓存
+// 适合测试由proxy持有哈希环的部署
+func WithoutPeers() Option {
+	return func(o *options) {
+		o.noPeers = true
+	}
+}
+
+// WithPeerWatch 让节点根据服务中心自动维护peers 而不是启动时一次性设置
+func WithPeerWatch() Option {
+	return func(o *options) {
+		o.peerWatch = true
+	}
+}
+
+// WithServerOptions 为每个节点的server追加选项
+func WithServerOptions(opts ...peanutcache.ServerOption) Option {
+	return func(o *options) {
+		o.serverOpts = append(o.serverOpts, opts...)
+	}
+}
+
+// NewCluster 启动一个n个节点的集群 默认每个节点都以全部节点作为peers
+// 启动失败时通过t结束测试 节点Serve返回的错误在 Kill 或 Close 时报告
+func NewCluster(t testing.TB, n int, opts ...Option) *Cluster {
+	t.Helper()
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	c := &Cluster{
+		t:        t,
+		Registry: NewRegistry(),
+		exited:   make(chan struct{}, n),
+		served:   make(map[string][]int),
+		killed:   make(map[int]bool),
+		failed:   make(map[int]bool),
+	}
+	for i := 0; i < n; i++ {
+		c.Addrs = append(c.Addrs, fmt.Sprintf("127.0.0.1:%d", basePort+i))
+	}
+	for i, addr := range c.Addrs {
+		node := peanutcache.NewNode()
+		svrOpts := []peanutcache.ServerOption{
+			peanutcache.WithRegistry(c.Registry),
+			peanutcache.WithDialOptions(c.Registry.DialOption(addr)),
+			peanutcache.WithGRPCServerOptions(
+				grpc.UnaryInterceptor(c.recorder(i)),
+				grpc.StreamInterceptor(c.streamRecorder(i)),
+			),
+		}
+		if o.peerWatch {
+			svrOpts = append(svrOpts, peanutcache.WithPeerWatch())
+		}
+		svrOpts = append(svrOpts, o.serverOpts...)
+		svr, err := node.NewServer(addr, svrOpts...)
+		if err != nil {
+			c.Close()
+			t.Fatalf("peanutcachetest: create server %s: %v", addr, err)
+		}
+		if !o.noPeers {
+			if !o.peerWatch {
+				svr.SetPeers(c.Addrs...)
+			}
+			node.RegisterPicker(svr)
+		}
+		c.servers = append(c.servers, svr)
+		lis := c.Registry.Listen(addr)
+		stopped := make(chan error, 1)
+		go func() {
+			// 不能在这里结束测试 错误交给测试goroutine报告
+			stopped <- svr.Serve(lis)
+			c.exited <- struct{}{}
+		}()
+		c.stopped = append(c.stopped, stopped)
+		c.Nodes = append(c.Nodes, node)
+	}
+	c.waitFor(func(addrs []string) bool { return len(addrs) == n })
+	return c
+}
+
+// NewGroup 在每个节点上创建同名的 Group 返回值与 Nodes 一一对应
+func (c *Cluster) NewGroup(name string, maxBytes int64, retriever peanutcache.Retriever, opts ...peanutcache.GroupOption) []*peanutcache.Group {
+	groups := make([]*peanutcache.Group, len(c.Nodes))
+	for i, node := range c.Nodes {
+		groups[i] = node.NewGroup(name, maxBytes, retriever, opts...)
+	}
+	return groups
+}
+
+// Get 从第i个节点获取group/key
+func (c *Cluster) Get(i int, group, key string) (peanutcache.ByteView, error) {
+	g := c.Nodes[i].GetGroup(group)
+	if g == nil {
+		return peanutcache.ByteView{}, fmt.Errorf("group %s not found on node %d", group, i)
+	}
+	return g.Get(key)
+}
+
+// Kill 停止第i个节点的server 并等待其从服务中心注销 Serve返回的错误通过t报告
+func (c *Cluster) Kill(i int) {
+	c.t.Helper()
+	c.mu.Lock()
+	if c.killed[i] {
+		c.mu.Unlock()
+		return
+	}
+	c.killed[i] = true
+	c.mu.Unlock()
+
+	c.Nodes[i].Stop()
+	select {
+	case err := <-c.stopped[i]:
+		if err != nil {
+			c.t.Errorf("peanutcachetest: serve %s: %v", c.Addrs[i], err)
+		}
+	case <-time.After(waitTimeout):
+		c.t.Fatalf("peanutcachetest: timeout waiting for %s to stop", c.Addrs[i])
+	}
+	addr := c.Addrs[i]
+	c.waitFor(func(addrs []string) bool {
+		for _, a := range addrs {
+			if a == addr {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// SetPeers 将第i个节点的peers设置为peers对应的节点 用于制造不一致的哈希环
+func (c *Cluster) SetPeers(i int, peers ...int) {
+	addrs := make([]string, len(peers))
+	for j, p := range peers {
+		addrs[j] = c.Addrs[p]
+	}
+	c.servers[i].SetPeers(addrs...)
+}
+
+// RingVersion 返回第i个节点哈希环的版本
+func (c *Cluster) RingVersion(i int) uint64 {
+	return c.servers[i].RingVersion()
+}
+
+// FailGets 让第i个节点以Unavailable拒绝来自peer的Get与GetStream请求
+// 其他RPC(例如Lease)不受影响 用于模拟归属节点过载或超时
+func (c *Cluster) FailGets(i int, fail bool) {
+	c.mu.Lock()
+	c.failed[i] = fail
+	c.mu.Unlock()
+}
+
+// Partition 隔离第i个与第j个节点 它们之间的请求将失败
+func (c *Cluster) Partition(i, j int) {
+	c.Registry.Cut(c.Addrs[i], c.Addrs[j])
+}
+
+// Heal 恢复所有被隔离的节点
+func (c *Cluster) Heal() {
+	c.Registry.Heal()
+}
+
+// ServedBy 返回依次通过RPC提供group/key的节点序号
+// 节点从本地提供自己拥有的key时不经过RPC 因此不会被记录
+func (c *Cluster) ServedBy(group, key string) []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int(nil), c.served[group+"/"+key]...)
+}
+
+// AssertServedBy 断言最近一次通过RPC提供group/key的是第want个节点
+func (c *Cluster) AssertServedBy(t testing.TB, group, key string, want int) {
+	t.Helper()
+	served := c.ServedBy(group, key)
+	if len(served) == 0 {
+		t.Fatalf("%s/%s was never served by a peer, want node %d", group, key, want)
+	}
+	if got := served[len(served)-1]; got != want {
+		t.Fatalf("%s/%s served by node %d, want node %d", group, key, got, want)
+	}
+}
+
+// ResetServed 清空RPC记录
+func (c *Cluster) ResetServed() {
+	c.mu.Lock()
+	c.served = make(map[string][]int)
+	c.mu.Unlock()
+}
+
+// Close 停止所有节点
+func (c *Cluster) Close() {
+	for i := range c.Nodes {
+		c.Kill(i)
+	}
+}
+
+// recorder 记录第i个节点通过RPC提供的key
+func (c *Cluster) recorder(i int) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if in, ok := req.(*pb.GetRequest); ok {
+			c.record(i, in)
+			if c.failing(i) {
+				return nil, status.Error(codes.Unavailable, "peanutcachetest: injected failure")
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// streamRecorder 记录第i个节点通过流式RPC提供的key
+func (c *Cluster) streamRecorder(i int) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &recordedStream{ServerStream: ss, c: c, i: i})
+	}
+}
+
+// recordedStream 在收到请求时记录
+type recordedStream struct {
+	grpc.ServerStream
+	c *Cluster
+	i int
+}
+
+func (s *recordedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if in, ok := m.(*pb.GetRequest); ok && err == nil {
+		s.c.record(s.i, in)
+		if s.c.failing(s.i) {
+			return status.Error(codes.Unavailable, "peanutcachetest: injected failure")
+		}
+	}
+	return err
+}
+
+func (c *Cluster) failing(i int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failed[i]
+}
+
+func (c *Cluster) record(i int, in *pb.GetRequest) {
+	c.mu.Lock()
+	k := in.GetGroup() + "/" + in.GetKey()
+	c.served[k] = append(c.served[k], i)
+	c.mu.Unlock()
+}
+
+// waitFor 等待服务中心中的地址满足cond 超时则结束测试
+func (c *Cluster) waitFor(cond func(addrs []string) bool) {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	ch, err := c.Registry.Watch(ctx, serviceName)
+	if err != nil {
+		c.t.Fatalf("peanutcachetest: watch registry: %v", err)
+	}
+	for {
+		select {
+		case addrs, ok := <-ch:
+			if !ok {
+				c.t.Fatalf("peanutcachetest: timeout waiting for registry%s", c.serveErrors())
+			}
+			if cond(addrs) {
+				return
+			}
+		case <-c.exited:
+			// 被 Kill 停止的节点不算错误
+			if msg := c.serveErrors(); msg != "" {
+				c.t.Fatalf("peanutcachetest: waiting for registry%s", msg)
+			}
+		}
+	}
+}
+
+// serveErrors 返回已经提前返回的Serve的错误 这些节点视为已停止
+func (c *Cluster) serveErrors() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var msg string
+	for i, stopped := range c.stopped {
+		if c.killed[i] {
+			continue
+		}
+		select {
+		case err := <-stopped:
+			c.killed[i] = true
+			msg += fmt.Sprintf(", %s stopped serving: %v", c.Addrs[i], err)
+		default:
+		}
+	}
+	return msg
+}
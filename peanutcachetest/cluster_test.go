@@ -0,0 +1,576 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcachetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/peanutzhen/peanutcache"
+	"github.com/peanutzhen/peanutcache/registry"
+	"google.golang.org/grpc"
+)
+
+var mysql = map[string]string{
+	"Tom":  "630",
+	"Jack": "589",
+	"Sam":  "567",
+}
+
+// counter 记录每个key向数据源的查询次数
+type counter struct {
+	mu    sync.Mutex
+	loads map[string]int
+}
+
+func (c *counter) retriever() peanutcache.Retriever {
+	c.loads = make(map[string]int)
+	return peanutcache.RetrieverFunc(func(key string) ([]byte, error) {
+		c.mu.Lock()
+		c.loads[key]++
+		c.mu.Unlock()
+		if v, ok := mysql[key]; ok {
+			return []byte(v), nil
+		}
+		return nil, fmt.Errorf("%s not exist", key)
+	})
+}
+
+func (c *counter) count(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loads[key]
+}
+
+func TestCluster_ConsistentOwner(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Close()
+	var db counter
+	c.NewGroup("scores", 2<<10, db.retriever())
+
+	for key, want := range mysql {
+		for i := range c.Nodes {
+			view, err := c.Get(i, "scores", key)
+			if err != nil || view.String() != want {
+				t.Fatalf("node %d get %s = %s, %v", i, key, view, err)
+			}
+		}
+		served := c.ServedBy("scores", key)
+		if len(served) != len(c.Nodes)-1 {
+			t.Fatalf("%s should be fetched from its owner by every other node, served by %v", key, served)
+		}
+		for _, owner := range served {
+			c.AssertServedBy(t, "scores", key, owner)
+		}
+		if n := db.count(key); n != 1 {
+			t.Fatalf("%s loaded %d times from db, want 1", key, n)
+		}
+	}
+}
+
+func TestCluster_KillOwner(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Close()
+	var db counter
+	c.NewGroup("scores", 2<<10, db.retriever())
+
+	// 找出Tom的owner
+	if _, err := c.Get(0, "scores", "Tom"); err != nil {
+		t.Fatal(err)
+	}
+	owner := 0
+	if served := c.ServedBy("scores", "Tom"); len(served) > 0 {
+		owner = served[0]
+	}
+	c.Kill(owner)
+
+	other := (owner + 1) % len(c.Nodes)
+	view, err := c.Get(other, "scores", "Tom")
+	if err != nil || view.String() != "630" {
+		t.Fatalf("node %d should fall back to local load, got %s, %v", other, view, err)
+	}
+}
+
+func TestCluster_Partition(t *testing.T) {
+	c := NewCluster(t, 2)
+	defer c.Close()
+	var db counter
+	c.NewGroup("scores", 2<<10, db.retriever())
+	c.Partition(0, 1)
+
+	for key, want := range mysql {
+		for i := range c.Nodes {
+			view, err := c.Get(i, "scores", key)
+			if err != nil || view.String() != want {
+				t.Fatalf("node %d get %s = %s, %v", i, key, view, err)
+			}
+		}
+		if served := c.ServedBy("scores", key); len(served) != 0 {
+			t.Fatalf("partitioned nodes should not reach each other, %s served by %v", key, served)
+		}
+	}
+}
+
+func TestCluster_NoForwardingLoop(t *testing.T) {
+	c := NewCluster(t, 2)
+	defer c.Close()
+	var db counter
+	groups := c.NewGroup("scores", 2<<10, db.retriever())
+	// 节点1的哈希环只有节点0 所有key都会被它转发给节点0
+	// 而节点0的哈希环中属于节点1的key会被转发给节点1 两者的哈希环不一致
+	c.SetPeers(1, 0)
+
+	for key := range mysql {
+		done := make(chan error, 1)
+		go func(key string) {
+			_, err := c.Get(0, "scores", key)
+			done <- err
+		}(key)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("request for %s bounced between nodes", key)
+		}
+		if served := c.ServedBy("scores", key); len(served) > 1 {
+			t.Fatalf("%s forwarded more than once: %v", key, served)
+		}
+	}
+	// 节点1的哈希环认为所有key都属于节点0 收到转发请求时均应计为bounce
+	if groups[1].Stats.ServerRequests.Get() == 0 || groups[1].Stats.Bounces.Get() != groups[1].Stats.ServerRequests.Get() {
+		t.Fatalf("bounces = %d, server requests = %d", groups[1].Stats.Bounces.Get(), groups[1].Stats.ServerRequests.Get())
+	}
+	if groups[0].Stats.Bounces.Get() != 0 {
+		t.Fatalf("node 0 should not see bounces, got %d", groups[0].Stats.Bounces.Get())
+	}
+}
+
+func TestCluster_RingResync(t *testing.T) {
+	c := NewCluster(t, 2, WithPeerWatch())
+	defer c.Close()
+	var db counter
+	c.NewGroup("scores", 2<<10, db.retriever())
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.RingVersion(0) == 0 || c.RingVersion(0) != c.RingVersion(1) {
+		if time.Now().After(deadline) {
+			t.Fatal("rings never agreed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := c.RingVersion(1)
+
+	// 节点0的哈希环丢失了节点1 与节点1通信时应当发现版本不一致并重新同步
+	c.SetPeers(0, 0)
+	for key := range mysql {
+		if _, err := c.Get(1, "scores", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for c.RingVersion(0) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("node 0 never resynced its ring: %d != %d", c.RingVersion(0), want)
+		}
+		for key := range mysql {
+			c.Get(1, "scores", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCluster_LargeValue(t *testing.T) {
+	// value超过gRPC默认的4MB消息限制 需要分段传输
+	large := bytes.Repeat([]byte("peanut"), 1<<20)
+	c := NewCluster(t, 2, WithServerOptions(peanutcache.WithChunkSize(256<<10)))
+	defer c.Close()
+	c.NewGroup("blobs", 64<<20, peanutcache.RetrieverFunc(func(key string) ([]byte, error) {
+		if key == "empty" {
+			return []byte{}, nil
+		}
+		return large, nil
+	}))
+
+	for _, key := range []string{"a", "b", "c", "d", "empty"} {
+		for i := range c.Nodes {
+			view, err := c.Get(i, "blobs", key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := large
+			if key == "empty" {
+				want = []byte{}
+			}
+			if !bytes.Equal(view.ByteSlice(), want) {
+				t.Fatalf("node %d got %d bytes for %s, want %d", i, view.Len(), key, len(want))
+			}
+		}
+		if len(c.ServedBy("blobs", key)) == 0 {
+			t.Fatalf("%s was never fetched from a peer", key)
+		}
+	}
+}
+
+// compressions 记录server收到的Get请求使用的gRPC压缩算法
+type compressions struct {
+	mu    sync.Mutex
+	names map[string]int
+}
+
+func (r *compressions) record(ctx context.Context, method string) {
+	if !strings.HasSuffix(method, "/Get") && !strings.HasSuffix(method, "/GetStream") {
+		return
+	}
+	name := ""
+	if s, ok := grpc.ServerTransportStreamFromContext(ctx).(interface{ RecvCompress() string }); ok {
+		name = s.RecvCompress()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names[name]++
+}
+
+func (r *compressions) option() Option {
+	return WithServerOptions(peanutcache.WithGRPCServerOptions(
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler) (interface{}, error) {
+			r.record(ctx, info.FullMethod)
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+			handler grpc.StreamHandler) error {
+			r.record(ss.Context(), info.FullMethod)
+			return handler(srv, ss)
+		}),
+	))
+}
+
+func TestCluster_Compression(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"Tom","score":630}`), 1<<10)
+	for _, codec := range []peanutcache.Compressor{peanutcache.Snappy, peanutcache.Zstd, peanutcache.Gzip} {
+		seen := &compressions{names: make(map[string]int)}
+		c := NewCluster(t, 2, seen.option())
+		c.NewGroup("docs", 2<<20, peanutcache.RetrieverFunc(func(key string) ([]byte, error) {
+			return value, nil
+		}), peanutcache.WithCompression(codec))
+		for _, key := range []string{"a", "b", "c", "d"} {
+			for i := range c.Nodes {
+				view, err := c.Get(i, "docs", key)
+				if err != nil {
+					t.Fatalf("%s: %v", codec.Name(), err)
+				}
+				if !bytes.Equal(view.ByteSlice(), value) {
+					t.Fatalf("%s: node %d got %d bytes for %s", codec.Name(), i, view.Len(), key)
+				}
+			}
+		}
+		c.Close()
+		// 节点之间的传输使用与缓存相同的压缩算法
+		seen.mu.Lock()
+		if len(seen.names) != 1 || seen.names[codec.Name()] == 0 {
+			t.Fatalf("%s: peers received requests compressed with %v", codec.Name(), seen.names)
+		}
+		seen.mu.Unlock()
+	}
+}
+
+func TestCluster_NotFound(t *testing.T) {
+	c := NewCluster(t, 2)
+	defer c.Close()
+	var mu sync.Mutex
+	loads := make([]int, 2)
+	groups := make([]*peanutcache.Group, 2)
+	for i, node := range c.Nodes {
+		i := i
+		groups[i] = node.NewGroup("scores", 2<<10, peanutcache.RetrieverFunc(func(key string) ([]byte, error) {
+			mu.Lock()
+			loads[i]++
+			mu.Unlock()
+			return nil, peanutcache.ErrNotFound
+		}), peanutcache.WithNegativeCache(1<<10, time.Minute))
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		for i := range c.Nodes {
+			for j := 0; j < 2; j++ {
+				if _, err := c.Get(i, "scores", key); !errors.Is(err, peanutcache.ErrNotFound) {
+					t.Fatalf("node %d: want ErrNotFound for %s, got %v", i, key, err)
+				}
+			}
+		}
+	}
+	// 每个key只在归属节点访问一次数据源 之后由两个节点的负缓存应答
+	mu.Lock()
+	defer mu.Unlock()
+	if loads[0]+loads[1] != 4 {
+		t.Fatalf("retriever called %v times, want 4 in total", loads)
+	}
+}
+
+func TestCluster_PeerErrors(t *testing.T) {
+	c := NewCluster(t, 2)
+	defer c.Close()
+	var mu sync.Mutex
+	loads := make([]int, 2)
+	retriever := func(i int, err error) peanutcache.Retriever {
+		return peanutcache.RetrieverFunc(func(key string) ([]byte, error) {
+			mu.Lock()
+			loads[i]++
+			mu.Unlock()
+			return []byte(key), err
+		})
+	}
+	// 数据源出错时 错误直接返回给请求方 请求方不会再访问自己的数据源
+	dbDown := errors.New("mysql: connection refused")
+	for i, node := range c.Nodes {
+		node.NewGroup("scores", 2<<10, retriever(i, dbDown))
+	}
+	// 只在节点0上创建 节点1拥有的key将因 ErrGroupNotFound 由节点0本地获取
+	c.Nodes[0].NewGroup("orders", 2<<10, retriever(0, nil))
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		_, err := c.Get(0, "scores", key)
+		if err == nil || errors.Is(err, peanutcache.ErrPeerUnavailable) {
+			t.Fatalf("want retriever error for %s, got %v", key, err)
+		}
+		if view, err := c.Get(0, "orders", key); err != nil || view.String() != key {
+			t.Fatalf("orders/%s should fall back locally, got %v", key, err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// scores的4个key与orders的4个key各访问一次数据源
+	if loads[0]+loads[1] != 8 || loads[0] < 4 {
+		t.Fatalf("retriever loads %v", loads)
+	}
+}
+
+func TestCluster_FillLease(t *testing.T) {
+	for _, lease := range []bool{false, true} {
+		c := NewCluster(t, 3)
+		var loads int32
+		var opts []peanutcache.GroupOption
+		if lease {
+			opts = append(opts, peanutcache.WithFillLease(time.Second))
+		}
+		c.NewGroup("scores", 2<<10, peanutcache.RetrieverFunc(func(key string) ([]byte, error) {
+			atomic.AddInt32(&loads, 1)
+			time.Sleep(50 * time.Millisecond)
+			return []byte(key), nil
+		}), opts...)
+		// 归属节点无法提供Get 所有节点都会从本地填充
+		for i := range c.Nodes {
+			c.FailGets(i, true)
+		}
+
+		var wg sync.WaitGroup
+		for i := range c.Nodes {
+			for j := 0; j < 3; j++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if view, err := c.Get(i, "scores", "Tom"); err != nil || view.String() != "Tom" {
+						t.Errorf("node %d got %s, %v", i, view, err)
+					}
+				}(i)
+			}
+		}
+		wg.Wait()
+		c.Close()
+
+		got := atomic.LoadInt32(&loads)
+		if lease && got != 1 {
+			t.Fatalf("with fill lease the database was hit %d times, want 1", got)
+		}
+		if !lease && got != 3 {
+			t.Fatalf("without fill lease every node should hit the database, got %d", got)
+		}
+	}
+}
+
+func TestCluster_FillLeaseReleasedOnError(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Close()
+	var loads int32
+	c.NewGroup("scores", 2<<10, peanutcache.RetrieverFunc(func(key string) ([]byte, error) {
+		time.Sleep(50 * time.Millisecond)
+		// 第一次访问数据源失败
+		if atomic.AddInt32(&loads, 1) == 1 {
+			return nil, errors.New("mysql: connection reset")
+		}
+		return []byte(key), nil
+	}), peanutcache.WithFillLease(5*time.Second))
+	for i := range c.Nodes {
+		c.FailGets(i, true)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var failed int32
+	for i := range c.Nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := c.Get(i, "scores", "Tom"); err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// 失败的持有者释放租约 其他节点不需要等待租约过期
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("waiters blocked for %v after the lease holder failed", elapsed)
+	}
+	if failed != 1 {
+		t.Fatalf("want only the failed holder to return an error, got %d", failed)
+	}
+}
+
+func TestCluster_BumpGeneration(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Close()
+	var db counter
+	groups := c.NewGroup("scores", 2<<10, db.retriever())
+
+	for i := range c.Nodes {
+		if _, err := c.Get(i, "scores", "Tom"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	owner := c.ServedBy("scores", "Tom")[0]
+	from := (owner + 1) % len(c.Nodes)
+
+	// 所有节点收到新的代数 归属节点重新加载一次
+	if gen, err := groups[from].BumpGeneration(""); err != nil || gen != 1 {
+		t.Fatalf("bump = %d, %v", gen, err)
+	}
+	for i, g := range groups {
+		if g.Generation("") != 1 {
+			t.Fatalf("node %d generation = %d, want 1", i, g.Generation(""))
+		}
+		if _, err := c.Get(i, "scores", "Tom"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := db.count("Tom"); n != 2 {
+		t.Fatalf("Tom loaded %d times, want 2", n)
+	}
+
+	// 归属节点没有收到通知时 请求携带的代数仍然使其重新加载
+	c.Partition(from, owner)
+	if _, err := groups[from].BumpGeneration("To"); err == nil {
+		t.Fatal("bump should report the unreachable owner")
+	}
+	c.Heal()
+	if groups[owner].Generation("To") != 0 {
+		t.Fatal("owner should have missed the bump")
+	}
+	if _, err := c.Get(from, "scores", "Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.count("Tom"); n != 3 {
+		t.Fatalf("Tom loaded %d times, want 3", n)
+	}
+	// 其他前缀不受影响
+	if _, err := c.Get(from, "scores", "Sam"); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.count("Sam"); n != 1 {
+		t.Fatalf("Sam loaded %d times, want 1", n)
+	}
+}
+
+func TestCluster_Scan(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Close()
+	var db counter
+	groups := c.NewGroup("scores", 2<<10, db.retriever())
+	for key := range mysql {
+		if _, err := c.Get(0, "scores", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	cursor := ""
+	for {
+		entries, next, err := groups[1].Scan("", 2, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			// 节点0获取自己拥有的key时不经过RPC
+			owner := 0
+			if served := c.ServedBy("scores", e.Key); len(served) > 0 {
+				owner = served[0]
+			}
+			want := c.Addrs[owner]
+			if owner == 1 {
+				want = ""
+			}
+			if e.Node != want {
+				t.Fatalf("%s reported on node %q, want %q", e.Key, e.Node, want)
+			}
+			keys = append(keys, e.Key)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if want := []string{"Jack", "Sam", "Tom"}; fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Fatalf("scanned %v, want %v", keys, want)
+	}
+}
+
+// fatalRecorder 记录 Fatalf 而不是结束外层的测试
+type fatalRecorder struct {
+	testing.TB
+	mu  sync.Mutex
+	msg string
+}
+
+func (r *fatalRecorder) Helper() {}
+
+func (r *fatalRecorder) Fatalf(format string, args ...interface{}) {
+	r.mu.Lock()
+	r.msg = fmt.Sprintf(format, args...)
+	r.mu.Unlock()
+	runtime.Goexit()
+}
+
+// failingRegistry 拒绝注册
+type failingRegistry struct {
+	registry.Registry
+}
+
+func (failingRegistry) Register(service, addr string) error {
+	return errors.New("registry unavailable")
+}
+
+func TestCluster_ServeErrorFailsTest(t *testing.T) {
+	r := &fatalRecorder{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewCluster(r, 1, WithServerOptions(peanutcache.WithRegistry(failingRegistry{registry.NewStatic()})))
+	}()
+	<-done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !strings.Contains(r.msg, "registry unavailable") {
+		t.Fatalf("Serve error should fail the test, got %q", r.msg)
+	}
+}
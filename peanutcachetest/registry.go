@@ -0,0 +1,87 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcachetest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/peanutzhen/peanutcache/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// registry 模块提供一个内存中的服务中心
+// 服务发现部分直接使用 registry.Static 与其他后端遵循相同的约定
+// 所有连接都通过 bufconn 在内存中建立 无需etcd和真实端口
+
+const bufSize = 1 << 20
+
+// Registry 是内存中的服务中心 同时负责创建/连接 bufconn listener
+type Registry struct {
+	*registry.Static
+
+	mu        sync.Mutex
+	listeners map[string]*bufconn.Listener // addr -> listener
+	cut       map[[2]string]bool           // 被分区隔离的两个地址
+}
+
+// NewRegistry 创建一个空的内存服务中心
+func NewRegistry() *Registry {
+	return &Registry{
+		Static:    registry.NewStatic(),
+		listeners: make(map[string]*bufconn.Listener),
+		cut:       make(map[[2]string]bool),
+	}
+}
+
+// Listen 为addr创建一个内存listener 旧的listener将被替换
+func (r *Registry) Listen(addr string) net.Listener {
+	lis := bufconn.Listen(bufSize)
+	r.mu.Lock()
+	r.listeners[addr] = lis
+	r.mu.Unlock()
+	return lis
+}
+
+// DialOption 返回地址为from的节点连接其他节点所用的grpc选项
+// 被 Cut 隔离的两个节点之间无法建立连接
+func (r *Registry) DialOption(from string) grpc.DialOption {
+	return grpc.WithContextDialer(func(ctx context.Context, to string) (net.Conn, error) {
+		if r.isCut(from, to) {
+			return nil, fmt.Errorf("%s is partitioned from %s", from, to)
+		}
+		r.mu.Lock()
+		lis, ok := r.listeners[to]
+		r.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("no listener on %s", to)
+		}
+		return lis.Dial()
+	})
+}
+
+// Cut 隔离两个地址 它们之间无法再建立新连接
+func (r *Registry) Cut(a, b string) {
+	r.mu.Lock()
+	r.cut[[2]string{a, b}] = true
+	r.cut[[2]string{b, a}] = true
+	r.mu.Unlock()
+}
+
+// Heal 恢复所有被隔离的连接
+func (r *Registry) Heal() {
+	r.mu.Lock()
+	r.cut = make(map[[2]string]bool)
+	r.mu.Unlock()
+}
+
+func (r *Registry) isCut(a, b string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cut[[2]string{a, b}]
+}
@@ -4,8 +4,31 @@
 
 package peanutcache
 
+import (
+	"context"
+	"fmt"
+	"github.com/peanutzhen/peanutcache/consistenthash"
+	"google.golang.org/grpc/metadata"
+	"log"
+	"strconv"
+	"sync"
+)
+
 // peers 模块
 
+// peer之间通过grpc metadata交换以下信息
+const (
+	mdRingVersion = "peanutcache-ring-version" // 发送方哈希环的版本
+	mdHops        = "peanutcache-hops"         // 请求已被转发的次数
+	maxHops       = 1                          // 已被转发过的请求不再转发
+)
+
+// MarkForwarded 标记ctx中的请求已被转发 接收请求的节点将只从本地获取
+// proxy等转发请求的一方应使用它 避免请求被再次转发
+func MarkForwarded(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, mdHops, strconv.Itoa(maxHops))
+}
+
 // Picker 定义了获取分布式节点的能力
 type Picker interface {
 	Pick(key string) (Fetcher, bool)
@@ -13,6 +36,107 @@ type Picker interface {
 
 // Fetcher 定义了从远端获取缓存的能力
 // 所以每个Peer应实现这个接口
+// Fetch 返回的[]byte交由 Group 持有 不会被复制 Fetcher 之后不能再修改它
 type Fetcher interface {
 	Fetch(group string, key string) ([]byte, error)
 }
+
+// broadcaster 由能够列出全部peer的 Picker 实现 用于通知所有peer
+type broadcaster interface {
+	peerFetchers() []Fetcher
+}
+
+// generationFetcher 由能够将key的代数发送给归属节点的 Fetcher 实现
+type generationFetcher interface {
+	fetchAt(group, key string, gen uint64) ([]byte, error)
+}
+
+// bumper 由能够通知peer增加代数的 Fetcher 实现
+type bumper interface {
+	bump(group, prefix string, gen uint64) error
+}
+
+// fetch 从f获取key 代数不为0且f支持时附带代数
+func fetch(f Fetcher, group, key string, gen uint64) ([]byte, error) {
+	if gf, ok := f.(generationFetcher); ok && gen != 0 {
+		return gf.fetchAt(group, key, gen)
+	}
+	return f.Fetch(group, key)
+}
+
+// NoPeerPicker 永远选择本地 使用它的 Group 只从本地Retriever填充缓存
+type NoPeerPicker struct{}
+
+func (NoPeerPicker) Pick(key string) (Fetcher, bool) {
+	return nil, false
+}
+
+// peerPicker 通过一致性哈希在一组peer中选择key的归属
+// self 是自身地址 选中自身时代表从本地获取
+type peerPicker struct {
+	self     string
+	mu       sync.Mutex
+	consHash *consistenthash.Consistency
+	clients  map[string]*client
+}
+
+// newPeerPicker 创建 peerPicker newClient负责创建访问各个peer的client
+// 注意: peersAddr必须满足 host:port的格式
+func newPeerPicker(self string, newClient func(peerAddr string) *client, peersAddr ...string) *peerPicker {
+	p := &peerPicker{
+		self:     self,
+		consHash: consistenthash.New(defaultReplicas, nil),
+		clients:  make(map[string]*client),
+	}
+	p.consHash.Register(peersAddr...)
+	for _, peerAddr := range peersAddr {
+		if !validPeerAddr(peerAddr) {
+			panic(fmt.Sprintf("[peer %s] invalid address format, it should be host:port", peerAddr))
+		}
+		p.clients[peerAddr] = newClient(peerAddr)
+	}
+	return p
+}
+
+// version 返回哈希环的版本
+func (p *peerPicker) version() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.consHash.Version()
+}
+
+// Pick 根据一致性哈希选举出key应存放在的cache
+// return false 代表从本地获取cache
+func (p *peerPicker) Pick(key string) (Fetcher, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peerAddr := p.consHash.GetPeer(key)
+	// Pick itself
+	if peerAddr == "" || peerAddr == p.self {
+		log.Printf("ooh! pick myself, I am %s\n", p.self)
+		return nil, false
+	}
+	log.Printf("[cache %s] pick remote peer: %s\n", p.self, peerAddr)
+	return p.clients[peerAddr], true
+}
+
+// peerFetchers 返回除自身外的全部peer
+func (p *peerPicker) peerFetchers() []Fetcher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fetchers := make([]Fetcher, 0, len(p.clients))
+	for addr, c := range p.clients {
+		if addr != p.self {
+			fetchers = append(fetchers, c)
+		}
+	}
+	return fetchers
+}
+
+// 测试是否实现了Picker接口
+var (
+	_ Picker      = NoPeerPicker{}
+	_ Picker      = (*peerPicker)(nil)
+	_ broadcaster = (*peerPicker)(nil)
+)
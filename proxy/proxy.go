@@ -0,0 +1,358 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package proxy 实现peanutcache的代理层
+//
+// 代理层对客户端提供与cache节点相同的 PeanutCache gRPC API
+// 它从服务发现中获取cache节点列表 维护唯一的一致性哈希环
+// 并把每个请求转发给key的归属节点 这样cache节点无需各自计算哈希环
+// 只需以no-peer模式运行(不调用 SetPeers 不注册 Picker) 从本地填充缓存
+//
+// Get GetStream Lease 与 Fill 转发给key的归属节点
+// Bump 转发给所有节点 Scan 汇总所有节点的记录
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/peanutzhen/peanutcache"
+	"github.com/peanutzhen/peanutcache/consistenthash"
+	pb "github.com/peanutzhen/peanutcache/peanutcachepb"
+	"github.com/peanutzhen/peanutcache/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultService  = "peanutcache"
+	defaultReplicas = 50
+)
+
+// Option 配置 Proxy 的可选项
+type Option func(*Proxy)
+
+// WithService 指定cache节点注册的服务名 默认为peanutcache
+func WithService(service string) Option {
+	return func(p *Proxy) {
+		p.service = service
+	}
+}
+
+// WithDialOptions 为连接cache节点追加grpc选项
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(p *Proxy) {
+		p.dialOpts = append(p.dialOpts, opts...)
+	}
+}
+
+// WithGRPCServerOptions 为代理的grpc server追加选项
+func WithGRPCServerOptions(opts ...grpc.ServerOption) Option {
+	return func(p *Proxy) {
+		p.grpcOpts = append(p.grpcOpts, opts...)
+	}
+}
+
+// Proxy 持有权威哈希环并转发请求
+type Proxy struct {
+	pb.UnimplementedPeanutCacheServer
+
+	registry registry.Registry
+	service  string
+	dialOpts []grpc.DialOption
+	grpcOpts []grpc.ServerOption
+
+	mu       sync.RWMutex
+	consHash *consistenthash.Consistency
+	nodes    []string                    // 当前的全部节点地址
+	conns    map[string]*grpc.ClientConn // 节点地址 -> 连接
+
+	cancel     context.CancelFunc
+	grpcServer *grpc.Server
+}
+
+// New 创建从r发现cache节点的 Proxy 并开始监听节点变化
+// 第一份节点列表同步获取 服务发现不可用时返回错误
+func New(r registry.Registry, opts ...Option) (*Proxy, error) {
+	p := &Proxy{
+		registry: r,
+		service:  defaultService,
+		consHash: consistenthash.New(defaultReplicas, nil),
+		conns:    make(map[string]*grpc.ClientConn),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	// 保证New返回后哈希环可用 Watch 的channel不保证推送 不能阻塞等待它
+	addrs, err := r.Resolve(p.service)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %w", p.service, err)
+	}
+	p.setNodes(addrs)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := r.Watch(ctx, p.service)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	p.cancel = cancel
+	go func() {
+		for addrs := range ch {
+			p.setNodes(addrs)
+		}
+	}()
+	return p, nil
+}
+
+// setNodes 以addrs重建哈希环 并关闭已离开节点的连接
+func (p *Proxy) setNodes(addrs []string) {
+	consHash := consistenthash.New(defaultReplicas, nil)
+	consHash.Register(addrs...)
+	alive := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		alive[addr] = true
+	}
+
+	p.mu.Lock()
+	p.consHash = consHash
+	p.nodes = append([]string(nil), addrs...)
+	var stale []*grpc.ClientConn
+	for addr, conn := range p.conns {
+		if !alive[addr] {
+			stale = append(stale, conn)
+			delete(p.conns, addr)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, conn := range stale {
+		conn.Close()
+	}
+	log.Printf("[proxy] cache nodes changed: %v", addrs)
+}
+
+// Owner 返回key的归属节点 没有可用节点时返回空字符串
+func (p *Proxy) Owner(key string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.consHash.GetPeer(key)
+}
+
+// conn 返回与addr的连接 连接在节点离开前一直复用
+func (p *Proxy) conn(addr string) (*grpc.ClientConn, error) {
+	p.mu.RLock()
+	conn, ok := p.conns[addr]
+	p.mu.RUnlock()
+	if ok {
+		return conn, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+	opts := append([]grpc.DialOption{grpc.WithInsecure()}, p.dialOpts...)
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+// route 返回与key的归属节点的连接 错误均为带状态码的gRPC错误
+func (p *Proxy) route(key string) (*grpc.ClientConn, string, error) {
+	if key == "" {
+		return nil, "", status.Error(codes.InvalidArgument, peanutcache.ErrKeyRequired.Error())
+	}
+	owner := p.Owner(key)
+	if owner == "" {
+		return nil, "", status.Error(codes.Unavailable, "no cache node available")
+	}
+	conn, err := p.conn(owner)
+	if err != nil {
+		return nil, "", status.Error(codes.Unavailable, err.Error())
+	}
+	return conn, owner, nil
+}
+
+// Get 实现PeanutCache service的Get接口 将请求转发给key的归属节点
+// 归属节点返回的gRPC错误原样返回给客户端
+func (p *Proxy) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	conn, owner, err := p.route(in.GetKey())
+	if err != nil {
+		return &pb.GetResponse{}, err
+	}
+	log.Printf("[proxy] forward (%s)/(%s) to %s", in.GetGroup(), in.GetKey(), owner)
+	return pb.NewPeanutCacheClient(conn).Get(peanutcache.MarkForwarded(ctx), in)
+}
+
+// GetStream 实现PeanutCache service的GetStream接口 将归属节点返回的分段原样转发
+func (p *Proxy) GetStream(in *pb.GetRequest, stream pb.PeanutCache_GetStreamServer) error {
+	conn, owner, err := p.route(in.GetKey())
+	if err != nil {
+		return err
+	}
+	log.Printf("[proxy] forward stream (%s)/(%s) to %s", in.GetGroup(), in.GetKey(), owner)
+	upstream, err := pb.NewPeanutCacheClient(conn).GetStream(peanutcache.MarkForwarded(stream.Context()), in)
+	if err != nil {
+		return err
+	}
+	for {
+		chunk, err := upstream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// Lease 实现PeanutCache service的Lease接口 转发给key的归属节点
+func (p *Proxy) Lease(ctx context.Context, in *pb.LeaseRequest) (*pb.LeaseResponse, error) {
+	conn, _, err := p.route(in.GetKey())
+	if err != nil {
+		return &pb.LeaseResponse{}, err
+	}
+	return pb.NewPeanutCacheClient(conn).Lease(ctx, in)
+}
+
+// Fill 实现PeanutCache service的Fill接口 转发给key的归属节点
+func (p *Proxy) Fill(ctx context.Context, in *pb.FillRequest) (*pb.FillResponse, error) {
+	conn, _, err := p.route(in.GetKey())
+	if err != nil {
+		return &pb.FillResponse{}, err
+	}
+	return pb.NewPeanutCacheClient(conn).Fill(ctx, in)
+}
+
+// Bump 实现PeanutCache service的Bump接口 转发给所有节点
+// 节点只接受更大的代数 因此generation必须由客户端指定 为0时节点忽略该请求
+func (p *Proxy) Bump(ctx context.Context, in *pb.BumpRequest) (*pb.BumpResponse, error) {
+	err := p.broadcast(func(client pb.PeanutCacheClient) error {
+		_, err := client.Bump(ctx, in)
+		return err
+	})
+	if err != nil {
+		st := status.Convert(err)
+		return &pb.BumpResponse{}, status.Errorf(st.Code(), "could not bump %s/%s: %s", in.GetGroup(), in.GetPrefix(), st.Message())
+	}
+	return &pb.BumpResponse{}, nil
+}
+
+// Scan 实现PeanutCache service的Scan接口 汇总所有节点的记录
+// 同一个key的记录不会被分到两页 任一节点失败时返回错误
+func (p *Proxy) Scan(ctx context.Context, in *pb.ScanRequest) (*pb.ScanResponse, error) {
+	var mu sync.Mutex
+	var entries []*pb.ScanEntry
+	more := false
+	err := p.broadcast(func(client pb.PeanutCacheClient) error {
+		resp, err := client.Scan(ctx, in)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		entries = append(entries, resp.GetEntries()...)
+		more = more || resp.GetNext() != ""
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		st := status.Convert(err)
+		return &pb.ScanResponse{}, status.Errorf(st.Code(), "could not scan %s: %s", in.GetGroup(), st.Message())
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].GetKey() < entries[j].GetKey() })
+	if limit := int(in.GetLimit()); limit > 0 && len(entries) > limit {
+		// 不拆分同一key在不同节点上的记录
+		n := limit
+		for n < len(entries) && entries[n].GetKey() == entries[limit-1].GetKey() {
+			n++
+		}
+		more = more || n < len(entries)
+		entries = entries[:n]
+	}
+	resp := &pb.ScanResponse{Entries: entries}
+	if more && len(entries) > 0 {
+		resp.Next = entries[len(entries)-1].GetKey()
+	}
+	return resp, nil
+}
+
+// broadcast 并发地对每个节点调用fn 返回第一个错误 错误均为带状态码的gRPC错误
+func (p *Proxy) broadcast(fn func(client pb.PeanutCacheClient) error) error {
+	p.mu.RLock()
+	nodes := p.nodes
+	p.mu.RUnlock()
+	if len(nodes) == 0 {
+		return status.Error(codes.Unavailable, "no cache node available")
+	}
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, addr := range nodes {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			conn, err := p.conn(addr)
+			if err != nil {
+				errs[i] = status.Error(codes.Unavailable, err.Error())
+				return
+			}
+			if err := fn(pb.NewPeanutCacheClient(conn)); err != nil {
+				st := status.Convert(err)
+				errs[i] = status.Errorf(st.Code(), "node %s: %s", addr, st.Message())
+			}
+		}(i, addr)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve 在lis上提供代理服务 直到 Stop 被调用
+func (p *Proxy) Serve(lis net.Listener) error {
+	p.mu.Lock()
+	if p.grpcServer != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("proxy already started")
+	}
+	p.grpcServer = grpc.NewServer(p.grpcOpts...)
+	pb.RegisterPeanutCacheServer(p.grpcServer, p)
+	grpcServer := p.grpcServer
+	p.mu.Unlock()
+	return grpcServer.Serve(lis)
+}
+
+// Stop 停止代理服务 停止监听节点变化并关闭所有连接
+func (p *Proxy) Stop() {
+	p.cancel()
+	p.mu.Lock()
+	grpcServer := p.grpcServer
+	conns := p.conns
+	p.conns = make(map[string]*grpc.ClientConn)
+	p.mu.Unlock()
+	if grpcServer != nil {
+		grpcServer.Stop()
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// 测试Proxy是否实现了PeanutCacheServer接口
+var _ pb.PeanutCacheServer = (*Proxy)(nil)
@@ -0,0 +1,224 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peanutzhen/peanutcache"
+	pb "github.com/peanutzhen/peanutcache/peanutcachepb"
+	"github.com/peanutzhen/peanutcache/peanutcachetest"
+	"github.com/peanutzhen/peanutcache/registry"
+	"google.golang.org/grpc"
+)
+
+const proxyAddr = "127.0.0.1:6320"
+
+// startProxy 在集群前启动代理 返回连接代理的client
+func startProxy(t *testing.T, c *peanutcachetest.Cluster) (*Proxy, pb.PeanutCacheClient) {
+	p, err := New(c.Registry, WithDialOptions(c.Registry.DialOption(proxyAddr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(c.Registry.Listen(proxyAddr))
+	conn, err := grpc.Dial(proxyAddr, grpc.WithInsecure(), c.Registry.DialOption("client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return p, pb.NewPeanutCacheClient(conn)
+}
+
+func TestProxy_ForwardToOwner(t *testing.T) {
+	c := peanutcachetest.NewCluster(t, 3, peanutcachetest.WithoutPeers())
+	defer c.Close()
+	var mu sync.Mutex
+	loads := make(map[string]int)
+	c.NewGroup("scores", 2<<10, peanutcache.RetrieverFunc(
+		func(key string) ([]byte, error) {
+			mu.Lock()
+			loads[key]++
+			mu.Unlock()
+			return []byte(key), nil
+		}))
+	p, client := startProxy(t, c)
+	defer p.Stop()
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%d", i)
+		for round := 0; round < 2; round++ {
+			resp, err := client.Get(context.Background(), &pb.GetRequest{Group: "scores", Key: key})
+			if err != nil || string(resp.GetValue()) != key {
+				t.Fatalf("get %s = %s, %v", key, resp.GetValue(), err)
+			}
+		}
+		owner := -1
+		for j, addr := range c.Addrs {
+			if addr == p.Owner(key) {
+				owner = j
+			}
+		}
+		c.AssertServedBy(t, "scores", key, owner)
+		if served := c.ServedBy("scores", key); len(served) != 2 {
+			t.Fatalf("%s should be served by its owner only, got %v", key, served)
+		}
+		if loads[key] != 1 {
+			t.Fatalf("%s loaded %d times, want 1", key, loads[key])
+		}
+	}
+}
+
+func TestProxy_NodeLeaves(t *testing.T) {
+	c := peanutcachetest.NewCluster(t, 2, peanutcachetest.WithoutPeers())
+	defer c.Close()
+	c.NewGroup("scores", 2<<10, peanutcache.RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	p, client := startProxy(t, c)
+	defer p.Stop()
+
+	c.Kill(1)
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Owner("Tom") != c.Addrs[0] || p.Owner("Jack") != c.Addrs[0] {
+		if time.Now().After(deadline) {
+			t.Fatal("proxy never removed the killed node from its ring")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, key := range []string{"Tom", "Jack"} {
+		if _, err := client.Get(context.Background(), &pb.GetRequest{Group: "scores", Key: key}); err != nil {
+			t.Fatal(err)
+		}
+		c.AssertServedBy(t, "scores", key, 0)
+	}
+}
+
+// stuckRegistry 的 Watch 从不推送 resolveErr非空时 Resolve 失败
+type stuckRegistry struct {
+	*registry.Static
+	resolveErr error
+}
+
+func (r stuckRegistry) Resolve(service string) ([]string, error) {
+	if r.resolveErr != nil {
+		return nil, r.resolveErr
+	}
+	return r.Static.Resolve(service)
+}
+
+func (r stuckRegistry) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	return make(chan []string), nil
+}
+
+func TestProxy_NewDoesNotBlock(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p, err := New(stuckRegistry{Static: registry.NewStatic("peanutcache/10.0.0.1:6324")})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer p.Stop()
+		if owner := p.Owner("Tom"); owner != "10.0.0.1:6324" {
+			t.Errorf("Owner = %q, want the resolved node", owner)
+		}
+		if _, err := New(stuckRegistry{Static: registry.NewStatic(), resolveErr: errors.New("dns timeout")}); err == nil {
+			t.Error("New should return the initial resolve error")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("New blocked waiting for Watch")
+	}
+}
+
+func TestProxy_LeaseAndFill(t *testing.T) {
+	c := peanutcachetest.NewCluster(t, 2, peanutcachetest.WithoutPeers())
+	defer c.Close()
+	c.NewGroup("scores", 2<<10, peanutcache.RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return nil, errors.New("database down")
+		}), peanutcache.WithFillLease(time.Second))
+	p, client := startProxy(t, c)
+	defer p.Stop()
+
+	ctx := context.Background()
+	lease, err := client.Lease(ctx, &pb.LeaseRequest{Group: "scores", Key: "Tom", Holder: "client"})
+	if err != nil || !lease.GetGranted() {
+		t.Fatalf("Lease = %v, %v", lease, err)
+	}
+	if _, err := client.Fill(ctx, &pb.FillRequest{Group: "scores", Key: "Tom", Holder: "client", Value: []byte("630")}); err != nil {
+		t.Fatal(err)
+	}
+	// 归属节点已缓存填充的值 不会访问数据源
+	resp, err := client.Get(ctx, &pb.GetRequest{Group: "scores", Key: "Tom"})
+	if err != nil || string(resp.GetValue()) != "630" {
+		t.Fatalf("get Tom = %s, %v", resp.GetValue(), err)
+	}
+}
+
+func TestProxy_BumpAndScan(t *testing.T) {
+	c := peanutcachetest.NewCluster(t, 3, peanutcachetest.WithoutPeers())
+	defer c.Close()
+	groups := c.NewGroup("scores", 64<<10, peanutcache.RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	p, client := startProxy(t, c)
+	defer p.Stop()
+
+	ctx := context.Background()
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		keys = append(keys, key)
+		if _, err := client.Get(ctx, &pb.GetRequest{Group: "scores", Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 分页汇总所有节点的记录
+	var scanned []string
+	cursor := ""
+	for {
+		resp, err := client.Scan(ctx, &pb.ScanRequest{Group: "scores", Limit: 7, Cursor: cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range resp.GetEntries() {
+			scanned = append(scanned, e.GetKey())
+		}
+		if resp.GetNext() == "" {
+			break
+		}
+		cursor = resp.GetNext()
+	}
+	if !reflect.DeepEqual(scanned, keys) {
+		t.Fatalf("scanned %v, want %v", scanned, keys)
+	}
+
+	// Bump 通知所有节点
+	if _, err := client.Bump(ctx, &pb.BumpRequest{Group: "scores", Prefix: "key", Generation: 3}); err != nil {
+		t.Fatal(err)
+	}
+	for i, g := range groups {
+		if gen := g.Generation("key"); gen != 3 {
+			t.Fatalf("node %d generation = %d, want 3", i, gen)
+		}
+	}
+	resp, err := client.Scan(ctx, &pb.ScanRequest{Group: "scores"})
+	if err != nil || len(resp.GetEntries()) != 0 {
+		t.Fatalf("bumped entries should not be listed, got %v, %v", resp.GetEntries(), err)
+	}
+}
@@ -5,22 +5,78 @@
 package registry
 
 import (
+	"context"
+
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/naming/resolver"
 	"google.golang.org/grpc"
+	gresolver "google.golang.org/grpc/resolver"
 )
 
 // EtcdDial 向grpc请求一个服务
 // 通过提供一个etcd client和service name即可获得Connection
-func EtcdDial(c *clientv3.Client, service string) (*grpc.ClientConn, error) {
+// opts追加在默认选项之后 例如通过 grpc.WithDefaultCallOptions 设置最大消息大小
+func EtcdDial(c *clientv3.Client, service string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
 	etcdResolver, err := resolver.NewBuilder(c)
 	if err != nil {
 		return nil, err
 	}
-	return grpc.Dial(
-		"etcd:///"+service,
+	opts = append([]grpc.DialOption{
 		grpc.WithResolvers(etcdResolver),
 		grpc.WithInsecure(),
 		grpc.WithBlock(),
-	)
+	}, opts...)
+	return grpc.Dial("etcd:///"+service, opts...)
+}
+
+// Dial 通过任意 Registry 向grpc请求一个服务
+// 连接的地址随 Registry 中service的变化而更新
+// 与 EtcdDial 不同 Dial不会阻塞等待连接建立
+func Dial(r Registry, service string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithResolvers(&resolverBuilder{r: r}),
+		grpc.WithInsecure(),
+	}, opts...)
+	return grpc.Dial(resolverScheme+":///"+service, opts...)
+}
+
+const resolverScheme = "registry"
+
+// resolverBuilder 将 Registry 适配为grpc的resolver
+type resolverBuilder struct {
+	r Registry
+}
+
+func (b *resolverBuilder) Build(target gresolver.Target, cc gresolver.ClientConn, _ gresolver.BuildOptions) (gresolver.Resolver, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := b.r.Watch(ctx, target.Endpoint)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		for addrs := range ch {
+			state := gresolver.State{}
+			for _, addr := range addrs {
+				state.Addresses = append(state.Addresses, gresolver.Address{Addr: addr})
+			}
+			cc.UpdateState(state)
+		}
+	}()
+	return &watchResolver{cancel: cancel}, nil
+}
+
+func (b *resolverBuilder) Scheme() string {
+	return resolverScheme
+}
+
+// watchResolver 在关闭时停止 Watch
+type watchResolver struct {
+	cancel context.CancelFunc
+}
+
+func (r *watchResolver) ResolveNow(gresolver.ResolveNowOptions) {}
+
+func (r *watchResolver) Close() {
+	r.cancel()
 }
@@ -0,0 +1,81 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package registry
+
+// dns 模块通过DNS SRV记录发现服务
+// 服务名 peanutcache 对应的SRV记录为 _peanutcache._tcp.<Domain>
+// 地址由DNS维护 因此DNS是只读的 Register/Deregister 将返回 ErrReadOnly
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS 是基于DNS SRV记录的只读 Registry
+type DNS struct {
+	Domain   string        // SRV记录所在的域 例如 cache.svc.cluster.local
+	Interval time.Duration // Watch 轮询间隔 为0时使用默认值
+
+	// lookupSRV 默认使用 net.DefaultResolver 测试时可以替换
+	lookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// NewDNS 创建查询domain下SRV记录的 DNS
+func NewDNS(domain string, interval time.Duration) *DNS {
+	return &DNS{
+		Domain:    domain,
+		Interval:  interval,
+		lookupSRV: net.DefaultResolver.LookupSRV,
+	}
+}
+
+// Register DNS不支持注册服务
+func (d *DNS) Register(service string, addr string) error {
+	return ErrReadOnly
+}
+
+// Deregister DNS不支持注销服务
+func (d *DNS) Deregister(service string, addr string) error {
+	return ErrReadOnly
+}
+
+// Resolve 查询service对应的SRV记录
+// service形如 peanutcache/127.0.0.1:6324 时只返回与该地址一致的记录
+func (d *DNS) Resolve(service string) ([]string, error) {
+	name, want := service, ""
+	if i := strings.Index(service, "/"); i >= 0 {
+		name, want = service[:i], service[i+1:]
+	}
+	lookup := d.lookupSRV
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupSRV
+	}
+	_, srvs, err := lookup(context.Background(), name, "tcp", d.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("lookup srv %s failed: %v", name, err)
+	}
+	var addrs []string
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		addr := net.JoinHostPort(host, fmt.Sprint(srv.Port))
+		if want == "" || addr == want {
+			addrs = append(addrs, addr)
+		}
+	}
+	return sortedAddrs(addrs), nil
+}
+
+// Watch 定期查询SRV记录 地址变化时推送
+func (d *DNS) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	return pollWatch(ctx, d.Interval, func() ([]string, error) {
+		return d.Resolve(service)
+	}), nil
+}
+
+// 测试DNS是否实现了Registry接口
+var _ Registry = (*DNS)(nil)
@@ -0,0 +1,257 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package registry
+
+// etcd 模块使用etcd实现 Registry
+// 每个注册的地址绑定一个租约 租约由心跳维持 进程退出后地址会自动过期
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/naming/endpoints"
+)
+
+// defaultLeaseTTL 租约过期时间(秒)
+const defaultLeaseTTL = 5
+
+// 心跳中断后以新的租约重新注册 失败时的重试间隔从minRetry开始倍增至maxRetry
+const (
+	minRetry = 500 * time.Millisecond
+	maxRetry = defaultLeaseTTL * time.Second
+)
+
+// Etcd 是基于etcd的 Registry
+type Etcd struct {
+	cli    *clientv3.Client
+	lessor clientv3.Lease
+	// put 将addr写入etcd 并绑定到租约上
+	put func(lid clientv3.LeaseID, service, addr string) error
+
+	mu     sync.Mutex
+	leases map[string]*etcdLease // service/addr -> 租约
+}
+
+type etcdLease struct {
+	id     clientv3.LeaseID   // 重新注册后会更新 持有Etcd.mu读写
+	cancel context.CancelFunc // 停止心跳以及重新注册
+}
+
+// NewEtcd 创建一个etcd client 并以此创建 Etcd
+func NewEtcd(config clientv3.Config) (*Etcd, error) {
+	cli, err := clientv3.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("create etcd client failed: %v", err)
+	}
+	return &Etcd{
+		cli:    cli,
+		lessor: cli,
+		put: func(lid clientv3.LeaseID, service, addr string) error {
+			return etcdAdd(cli, lid, service, addr)
+		},
+		leases: make(map[string]*etcdLease),
+	}, nil
+}
+
+// Register 在租赁模式下将addr注册至etcd 并在后台维持心跳
+// 心跳中断(例如租约已过期)后会以新的租约重新注册 直到 Deregister 或 Close
+func (e *Etcd) Register(service string, addr string) error {
+	key := endpointKey(service, addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	id, ch, err := e.grant(ctx, service, addr)
+	if err != nil {
+		cancel()
+		return err
+	}
+	lease := &etcdLease{id: id, cancel: cancel}
+	e.mu.Lock()
+	old, ok := e.leases[key]
+	e.leases[key] = lease
+	e.mu.Unlock()
+	go e.keepAlive(ctx, lease, ch, service, addr)
+	if ok {
+		e.revoke(old)
+	}
+	log.Printf("[%s] register service ok\n", addr)
+	return nil
+}
+
+// grant 创建一个新的租约 将addr绑定到该租约并开始心跳
+func (e *Etcd) grant(ctx context.Context, service, addr string) (clientv3.LeaseID, <-chan *clientv3.LeaseKeepAliveResponse, error) {
+	// 创建一个租约 配置5秒过期
+	resp, err := e.lessor.Grant(ctx, defaultLeaseTTL)
+	if err != nil {
+		return 0, nil, fmt.Errorf("create lease failed: %v", err)
+	}
+	// 注册服务
+	if err := e.put(resp.ID, service, addr); err != nil {
+		return 0, nil, fmt.Errorf("add etcd record failed: %v", err)
+	}
+	// 设置服务心跳检测
+	ch, err := e.lessor.KeepAlive(ctx, resp.ID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("set keepalive failed: %v", err)
+	}
+	return resp.ID, ch, nil
+}
+
+// keepAlive 消费心跳响应 心跳中断且未被注销时以新的租约重新注册
+// 否则租约过期后addr会从etcd中消失 节点仍在服务却再也不会被发现
+func (e *Etcd) keepAlive(ctx context.Context, lease *etcdLease, ch <-chan *clientv3.LeaseKeepAliveResponse, service, addr string) {
+	key := endpointKey(service, addr)
+	for {
+		for range ch {
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[%s] keep alive channel closed, register again", key)
+		retry := minRetry
+		for {
+			id, next, err := e.grant(ctx, service, addr)
+			if err == nil {
+				e.mu.Lock()
+				current := e.leases[key] == lease
+				if current {
+					lease.id = id
+				}
+				e.mu.Unlock()
+				if !current {
+					// 重新注册期间已被注销或被另一次 Register 取代
+					e.lessor.Revoke(context.Background(), id)
+					return
+				}
+				ch = next
+				log.Printf("[%s] register service again ok", key)
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("[%s] register again failed, retry in %v: %v", key, retry, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			if retry *= 2; retry > maxRetry {
+				retry = maxRetry
+			}
+		}
+	}
+}
+
+// Deregister 停止心跳并撤销租约 租约下的地址随之删除
+func (e *Etcd) Deregister(service string, addr string) error {
+	key := endpointKey(service, addr)
+	e.mu.Lock()
+	lease, ok := e.leases[key]
+	delete(e.leases, key)
+	e.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return e.revoke(lease)
+}
+
+// revoke 撤销已从leases中移除的租约 移除后租约的id不会再被修改
+func (e *Etcd) revoke(lease *etcdLease) error {
+	lease.cancel()
+	_, err := e.lessor.Revoke(context.Background(), lease.id)
+	return err
+}
+
+// Resolve 返回etcd中service下的全部地址
+func (e *Etcd) Resolve(service string) ([]string, error) {
+	em, err := endpoints.NewManager(e.cli, service)
+	if err != nil {
+		return nil, err
+	}
+	eps, err := em.List(e.cli.Ctx())
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for key, ep := range eps {
+		if matchService(key, service) {
+			addrs = append(addrs, ep.Addr)
+		}
+	}
+	return sortedAddrs(addrs), nil
+}
+
+// Watch 监听etcd中service下的地址变化
+func (e *Etcd) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	em, err := endpoints.NewManager(e.cli, service)
+	if err != nil {
+		return nil, err
+	}
+	wch, err := em.NewWatchChannel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]string) // key -> addr
+	apply := func(updates []*endpoints.Update) []string {
+		for _, up := range updates {
+			if !matchService(up.Key, service) {
+				continue
+			}
+			switch up.Op {
+			case endpoints.Add:
+				current[up.Key] = up.Endpoint.Addr
+			case endpoints.Delete:
+				delete(current, up.Key)
+			}
+		}
+		addrs := make([]string, 0, len(current))
+		for _, addr := range current {
+			addrs = append(addrs, addr)
+		}
+		return sortedAddrs(addrs)
+	}
+
+	ch := make(chan []string, 1)
+	// 已存在的地址会在NewWatchChannel返回前写入wch
+	select {
+	case updates := <-wch:
+		SendLatest(ch, apply(updates))
+	default:
+		SendLatest(ch, apply(nil))
+	}
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case updates, ok := <-wch:
+				if !ok {
+					return
+				}
+				SendLatest(ch, apply(updates))
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Close 撤销全部租约并关闭etcd client
+func (e *Etcd) Close() error {
+	e.mu.Lock()
+	leases := e.leases
+	e.leases = make(map[string]*etcdLease)
+	e.mu.Unlock()
+	for _, lease := range leases {
+		e.revoke(lease)
+	}
+	return e.cli.Close()
+}
+
+// 测试Etcd是否实现了Registry接口
+var _ Registry = (*Etcd)(nil)
@@ -0,0 +1,129 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fakeLessor 在内存中模拟etcd的租约 expire模拟租约过期导致心跳中断
+type fakeLessor struct {
+	clientv3.Lease
+
+	mu         sync.Mutex
+	next       clientv3.LeaseID
+	failGrants int // 接下来Grant失败的次数
+	alive      map[clientv3.LeaseID]chan *clientv3.LeaseKeepAliveResponse
+	revoked    []clientv3.LeaseID
+}
+
+func (f *fakeLessor) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failGrants > 0 {
+		f.failGrants--
+		return nil, errors.New("etcd unavailable")
+	}
+	f.next++
+	return &clientv3.LeaseGrantResponse{ID: f.next}, nil
+}
+
+func (f *fakeLessor) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan *clientv3.LeaseKeepAliveResponse)
+	f.alive[id] = ch
+	go func() {
+		<-ctx.Done()
+		f.expire(id)
+	}()
+	return ch, nil
+}
+
+func (f *fakeLessor) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revoked = append(f.revoked, id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+// expire 关闭租约的心跳channel
+func (f *fakeLessor) expire(id clientv3.LeaseID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ch, ok := f.alive[id]; ok {
+		close(ch)
+		delete(f.alive, id)
+	}
+}
+
+func TestEtcd_RegisterAgainAfterLeaseExpired(t *testing.T) {
+	f := &fakeLessor{alive: make(map[clientv3.LeaseID]chan *clientv3.LeaseKeepAliveResponse)}
+	puts := make(chan clientv3.LeaseID, 10)
+	e := &Etcd{
+		lessor: f,
+		put: func(lid clientv3.LeaseID, service, addr string) error {
+			puts <- lid
+			return nil
+		},
+		leases: make(map[string]*etcdLease),
+	}
+	waitPut := func(want clientv3.LeaseID) {
+		t.Helper()
+		select {
+		case lid := <-puts:
+			if lid != want {
+				t.Fatalf("addr put with lease %d, want %d", lid, want)
+			}
+		case <-time.After(2 * maxRetry):
+			t.Fatalf("addr was not put with lease %d", want)
+		}
+	}
+
+	if err := e.Register("pcache", "127.0.0.1:7000"); err != nil {
+		t.Fatal(err)
+	}
+	waitPut(1)
+
+	// 租约过期后以新的租约重新注册
+	f.expire(1)
+	waitPut(2)
+
+	// 重新注册失败时退避重试
+	f.mu.Lock()
+	f.failGrants = 1
+	f.mu.Unlock()
+	f.expire(2)
+	waitPut(3)
+
+	e.mu.Lock()
+	id := e.leases[endpointKey("pcache", "127.0.0.1:7000")].id
+	e.mu.Unlock()
+	if id != 3 {
+		t.Fatalf("lease = %d after registering again, want 3", id)
+	}
+
+	// 注销撤销当前的租约 之后不再重新注册
+	if err := e.Deregister("pcache", "127.0.0.1:7000"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case lid := <-puts:
+		t.Fatalf("deregistered addr put again with lease %d", lid)
+	case <-time.After(2 * minRetry):
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !reflect.DeepEqual(f.revoked, []clientv3.LeaseID{3}) {
+		t.Fatalf("revoked %v, want [3]", f.revoked)
+	}
+}
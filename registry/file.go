@@ -0,0 +1,140 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package registry
+
+// file 模块通过本地peers文件发现服务 适合没有etcd的环境
+// 文件每行一个 service/addr 空行以及以#开头的行会被忽略 例如:
+//
+//	# peanutcache peers
+//	peanutcache/10.0.0.1:6324
+//	peanutcache/10.0.0.2:6324
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File 是基于本地peers文件的 Registry
+type File struct {
+	path     string
+	interval time.Duration // Watch 轮询间隔
+
+	mu sync.Mutex // 串行化对文件的修改
+}
+
+// NewFile 创建读取path的 File interval为0时使用默认轮询间隔
+func NewFile(path string, interval time.Duration) *File {
+	return &File{path: path, interval: interval}
+}
+
+// Register 将service/addr追加至peers文件
+// 注意: 修改peers文件时 文件中的注释不会被保留
+func (f *File) Register(service string, addr string) error {
+	key := endpointKey(service, addr)
+	return f.update(func(keys []string) []string {
+		for _, k := range keys {
+			if k == key {
+				return keys
+			}
+		}
+		return append(keys, key)
+	})
+}
+
+// Deregister 将service/addr从peers文件删除
+func (f *File) Deregister(service string, addr string) error {
+	key := endpointKey(service, addr)
+	return f.update(func(keys []string) []string {
+		kept := keys[:0]
+		for _, k := range keys {
+			if k != key {
+				kept = append(kept, k)
+			}
+		}
+		return kept
+	})
+}
+
+// Resolve 返回peers文件中service下的全部地址
+func (f *File) Resolve(service string) ([]string, error) {
+	keys, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, key := range keys {
+		if matchService(key, service) {
+			addrs = append(addrs, key[strings.LastIndex(key, "/")+1:])
+		}
+	}
+	return sortedAddrs(addrs), nil
+}
+
+// Watch 定期读取peers文件 地址变化时推送
+func (f *File) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	return pollWatch(ctx, f.interval, func() ([]string, error) {
+		return f.Resolve(service)
+	}), nil
+}
+
+// read 读取peers文件中的全部 service/addr 文件不存在视为空
+func (f *File) read() ([]string, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || !strings.Contains(line, "/") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, scanner.Err()
+}
+
+// update 修改peers文件 先写临时文件再rename 保证读者不会读到写了一半的文件
+func (f *File) update(fn func(keys []string) []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys, err := f.read()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, key := range fn(keys) {
+		buf.WriteString(key)
+		buf.WriteByte('\n')
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// 测试File是否实现了Registry接口
+var _ Registry = (*File)(nil)
@@ -7,8 +7,6 @@ package registry
 // register模块提供服务Service注册至etcd的能力
 
 import (
-	"context"
-	"fmt"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/naming/endpoints"
 	"log"
@@ -34,49 +32,24 @@ func etcdAdd(c *clientv3.Client, lid clientv3.LeaseID, service string, addr stri
 
 // Register 注册一个服务至etcd
 // 注意 Register将不会return 如果没有error的话
+// 直到stop收到信号 才撤销服务并return
 func Register(service string, addr string, stop chan error) error {
-	// 创建一个etcd client
-	cli, err := clientv3.New(defaultEtcdConfig)
+	e, err := NewEtcd(defaultEtcdConfig)
 	if err != nil {
-		return fmt.Errorf("create etcd client failed: %v", err)
-	}
-	defer cli.Close()
-	// 创建一个租约 配置5秒过期
-	resp, err := cli.Grant(context.Background(), 5)
-	if err != nil {
-		return fmt.Errorf("create lease failed: %v", err)
-	}
-	leaseId := resp.ID
-	// 注册服务
-	err = etcdAdd(cli, leaseId, service, addr)
-	if err != nil {
-		return fmt.Errorf("add etcd record failed: %v", err)
+		return err
 	}
-	// 设置服务心跳检测
-	ch, err := cli.KeepAlive(context.Background(), leaseId)
-	if err != nil {
-		return fmt.Errorf("set keepalive failed: %v", err)
+	defer e.Close()
+	if err := e.Register(service, addr); err != nil {
+		return err
 	}
-
-	log.Printf("[%s] register service ok\n", addr)
-	for {
-		select {
-		case err := <-stop:
-			if err != nil {
-				log.Println(err)
-			}
-			return err
-		case <-cli.Ctx().Done():
-			log.Println("service closed")
-			return nil
-		case _, ok := <-ch:
-			// 监听租约
-			if !ok {
-				log.Println("keep alive channel closed")
-				_, err := cli.Revoke(context.Background(), leaseId)
-				return err
-			}
-			//log.Printf("Recv reply from service: %s/%s, ttl:%d", service, addr, resp.TTL)
+	select {
+	case err := <-stop:
+		if err != nil {
+			log.Println(err)
 		}
+		return err
+	case <-e.cli.Ctx().Done():
+		log.Println("service closed")
+		return nil
 	}
 }
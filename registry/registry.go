@@ -0,0 +1,111 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package registry
+
+// registry 模块定义服务发现后端的约定
+// 服务地址以 service/addr 为key注册 通过服务名即可解析出对应的地址
+// 例如 peanutcache/127.0.0.1:6324 既可以通过 peanutcache 解析
+// 也可以通过 peanutcache/127.0.0.1:6324 精确解析
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrReadOnly 表示该后端不支持注册/注销服务
+var ErrReadOnly = errors.New("registry: backend is read-only")
+
+// defaultPollInterval 是轮询式后端 Watch 的默认间隔
+const defaultPollInterval = 5 * time.Second
+
+// Registry 定义了服务注册与发现的能力
+type Registry interface {
+	// Register 将addr注册至service下 直到 Deregister 前保持有效
+	Register(service string, addr string) error
+	// Deregister 将addr从service下注销
+	Deregister(service string, addr string) error
+	// Resolve 返回service下当前的全部地址
+	Resolve(service string) ([]string, error)
+	// Watch 监听service下的地址变化
+	// channel首先推送当前的全部地址 之后每次变化推送一次全量地址
+	// ctx结束后channel将被关闭
+	Watch(ctx context.Context, service string) (<-chan []string, error)
+}
+
+// endpointKey 返回addr注册在service下的key
+func endpointKey(service string, addr string) string {
+	return service + "/" + addr
+}
+
+// matchService 判断key是否属于service
+func matchService(key string, service string) bool {
+	return key == service || strings.HasPrefix(key, service+"/")
+}
+
+// SendLatest 推送最新的地址列表 若上一次推送尚未被读取则替换它
+// 供 Registry 的实现编写 Watch 使用 ch需要有1个缓冲 且只能有一个写者
+func SendLatest(ch chan []string, addrs []string) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- addrs
+}
+
+// pollWatch 以interval轮询resolve 地址变化时推送全量地址
+func pollWatch(ctx context.Context, interval time.Duration, resolve func() ([]string, error)) <-chan []string {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ch := make(chan []string, 1)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var last []string
+		first := true
+		for {
+			if addrs, err := resolve(); err == nil && (first || !equalAddrs(addrs, last)) {
+				SendLatest(ch, addrs)
+				last, first = addrs, false
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return ch
+}
+
+// sortedAddrs 去重并排序地址
+func sortedAddrs(addrs []string) []string {
+	seen := make(map[string]bool, len(addrs))
+	sorted := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !seen[addr] {
+			seen[addr] = true
+			sorted = append(sorted, addr)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func equalAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
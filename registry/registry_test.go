@@ -0,0 +1,106 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRegistry 测试 Registry 的注册/注销/解析/监听
+func testRegistry(t *testing.T, r Registry) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := r.Watch(ctx, "peanutcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case addrs := <-ch:
+				if len(addrs) == len(want) && (len(want) == 0 || reflect.DeepEqual(addrs, want)) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("watch never reported %v", want)
+			}
+		}
+	}
+	expect()
+
+	if err := r.Register("peanutcache", "127.0.0.1:6324"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("peanutcache", "127.0.0.1:6325"); err != nil {
+		t.Fatal(err)
+	}
+	expect("127.0.0.1:6324", "127.0.0.1:6325")
+
+	addrs, err := r.Resolve("peanutcache/127.0.0.1:6325")
+	if err != nil || !reflect.DeepEqual(addrs, []string{"127.0.0.1:6325"}) {
+		t.Fatalf("Resolve = %v, %v", addrs, err)
+	}
+
+	if err := r.Deregister("peanutcache", "127.0.0.1:6324"); err != nil {
+		t.Fatal(err)
+	}
+	expect("127.0.0.1:6325")
+}
+
+func TestStatic(t *testing.T) {
+	testRegistry(t, NewStatic())
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	testRegistry(t, NewFile(path, 10*time.Millisecond))
+}
+
+func TestDNS_Resolve(t *testing.T) {
+	d := NewDNS("cache.local", time.Second)
+	d.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if service != "peanutcache" || proto != "tcp" || name != "cache.local" {
+			t.Fatalf("unexpected lookup _%s._%s.%s", service, proto, name)
+		}
+		return "", []*net.SRV{
+			{Target: "10.0.0.2.", Port: 6324},
+			{Target: "10.0.0.1.", Port: 6324},
+		}, nil
+	}
+	addrs, err := d.Resolve("peanutcache")
+	if err != nil || !reflect.DeepEqual(addrs, []string{"10.0.0.1:6324", "10.0.0.2:6324"}) {
+		t.Fatalf("Resolve = %v, %v", addrs, err)
+	}
+	addrs, err = d.Resolve("peanutcache/10.0.0.2:6324")
+	if err != nil || !reflect.DeepEqual(addrs, []string{"10.0.0.2:6324"}) {
+		t.Fatalf("Resolve = %v, %v", addrs, err)
+	}
+	if err := d.Register("peanutcache", "10.0.0.3:6324"); err != ErrReadOnly {
+		t.Fatalf("Register = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestDNS_ResolveHostname(t *testing.T) {
+	// 例如Kubernetes headless service 的SRV记录以主机名作为target
+	d := NewDNS("cache.local", time.Second)
+	d.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return "", []*net.SRV{
+			{Target: "cache-1.cache.local.", Port: 6324},
+			{Target: "cache-0.cache.local.", Port: 6324},
+		}, nil
+	}
+	addrs, err := d.Resolve("peanutcache")
+	want := []string{"cache-0.cache.local:6324", "cache-1.cache.local:6324"}
+	if err != nil || !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("Resolve = %v, %v, want %v", addrs, err, want)
+	}
+}
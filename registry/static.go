@@ -0,0 +1,102 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package registry
+
+// static 模块提供一份保存在内存中的服务列表
+// 适合peers固定的部署 以及不依赖etcd的测试
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Static 是保存在内存中的 Registry
+type Static struct {
+	mu        sync.Mutex
+	endpoints map[string]string // service/addr -> addr
+	watchers  map[*staticWatcher]struct{}
+}
+
+type staticWatcher struct {
+	service string
+	ch      chan []string
+}
+
+// NewStatic 创建 Static endpoints 的格式为 service/addr
+func NewStatic(endpoints ...string) *Static {
+	s := &Static{
+		endpoints: make(map[string]string),
+		watchers:  make(map[*staticWatcher]struct{}),
+	}
+	for _, key := range endpoints {
+		if i := strings.LastIndex(key, "/"); i >= 0 {
+			s.endpoints[key] = key[i+1:]
+		}
+	}
+	return s
+}
+
+// Register 将addr加入service
+func (s *Static) Register(service string, addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoints[endpointKey(service, addr)] = addr
+	s.notifyLocked()
+	return nil
+}
+
+// Deregister 将addr移出service
+func (s *Static) Deregister(service string, addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.endpoints, endpointKey(service, addr))
+	s.notifyLocked()
+	return nil
+}
+
+// Resolve 返回service下的全部地址
+func (s *Static) Resolve(service string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resolveLocked(service), nil
+}
+
+// Watch 监听service下的地址变化
+func (s *Static) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	w := &staticWatcher{service: service, ch: make(chan []string, 1)}
+	s.mu.Lock()
+	s.watchers[w] = struct{}{}
+	SendLatest(w.ch, s.resolveLocked(service))
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.watchers, w)
+		close(w.ch)
+		s.mu.Unlock()
+	}()
+	return w.ch, nil
+}
+
+func (s *Static) resolveLocked(service string) []string {
+	var addrs []string
+	for key, addr := range s.endpoints {
+		if matchService(key, service) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return sortedAddrs(addrs)
+}
+
+func (s *Static) notifyLocked() {
+	for w := range s.watchers {
+		SendLatest(w.ch, s.resolveLocked(w.service))
+	}
+}
+
+// 测试Static是否实现了Registry接口
+var _ Registry = (*Static)(nil)
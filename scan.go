@@ -0,0 +1,143 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// scan 模块提供列出 Group 中记录的能力 用于调试 导出以及按前缀失效
+// 记录按key排序 以上一页最后一个key作为cursor分页 因此在缓存并发修改时分页依然有效
+// 每一页都需要遍历整个缓存 不应在请求路径上频繁调用
+// 只列出内存中当前代数且未过期的记录 不包括磁盘层
+
+const rangePageSize = 256
+
+// EntryInfo 是缓存中一条记录的信息
+type EntryInfo struct {
+	Key  string
+	Node string        // 缓存该记录的peer地址 为空表示本节点
+	Size int64         // 占用的内存 包括每条记录的额外开销
+	Age  time.Duration // 写入至今的时间
+	Idle time.Duration // 上次访问至今的时间
+}
+
+// Entries 返回key以prefix开头且大于cursor的记录 按key排序 最多limit条
+// limit小于等于0时不限制 next不为空时表示还有更多记录 作为下一页的cursor
+func (g *Group) Entries(prefix string, limit int, cursor string) (entries []EntryInfo, next string) {
+	now := time.Now()
+	for _, s := range g.cache.snapshot() {
+		key := originalKey(s.key)
+		if !strings.HasPrefix(key, prefix) || key <= cursor {
+			continue
+		}
+		// 旧代数的记录已经失效 只是尚未被淘汰
+		if cacheKey(key, g.gens.of(key)) != s.key {
+			continue
+		}
+		if !s.hard.IsZero() && now.After(s.hard) {
+			continue
+		}
+		entries = append(entries, EntryInfo{
+			Key:  key,
+			Size: s.size,
+			Age:  now.Sub(s.ctime),
+			Idle: now.Sub(s.atime),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+		next = entries[limit-1].Key
+	}
+	return entries, next
+}
+
+// Keys 与 Entries 相同 但只返回key
+func (g *Group) Keys(prefix string, limit int, cursor string) (keys []string, next string) {
+	entries, next := g.Entries(prefix, limit, cursor)
+	keys = make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys, next
+}
+
+// Range 按key的顺序对key以prefix开头的每条记录调用fn fn返回false时停止
+// fn可以修改 Group 例如调用 Remove
+func (g *Group) Range(prefix string, fn func(EntryInfo) bool) {
+	cursor := ""
+	for {
+		entries, next := g.Entries(prefix, rangePageSize, cursor)
+		for _, e := range entries {
+			if !fn(e) {
+				return
+			}
+		}
+		if next == "" {
+			return
+		}
+		cursor = next
+	}
+}
+
+// scanner 由能够列出peer中记录的 Fetcher 实现
+type scanner interface {
+	scan(group, prefix string, limit int, cursor string) ([]EntryInfo, string, error)
+}
+
+// Scan 与 Entries 相同 但汇总本节点与 Picker 中所有peer的记录
+// 同一个key可能被多个节点缓存 它们按 EntryInfo.Node 区分 同一key的记录不会被分到两页
+// 部分peer失败时 仍返回其他节点的记录 同时返回错误
+func (g *Group) Scan(prefix string, limit int, cursor string) ([]EntryInfo, string, error) {
+	entries, next := g.Entries(prefix, limit, cursor)
+	more := next != ""
+	var failed int
+	var first error
+	if b, ok := g.picker().(broadcaster); ok {
+		for _, f := range b.peerFetchers() {
+			s, ok := f.(scanner)
+			if !ok {
+				continue
+			}
+			peerEntries, peerNext, err := s.scan(g.name, prefix, limit, cursor)
+			if err != nil {
+				failed++
+				if first == nil {
+					first = err
+				}
+				continue
+			}
+			entries = append(entries, peerEntries...)
+			more = more || peerNext != ""
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Node < entries[j].Node
+	})
+	next = ""
+	if limit > 0 && len(entries) > limit {
+		// 不拆分同一key在不同节点上的记录
+		n := limit
+		for n < len(entries) && entries[n].Key == entries[limit-1].Key {
+			n++
+		}
+		more = more || n < len(entries)
+		entries = entries[:n]
+	}
+	if more && len(entries) > 0 {
+		next = entries[len(entries)-1].Key
+	}
+	if first != nil {
+		return entries, next, fmt.Errorf("could not scan %s on %d peers: %w", g.name, failed, first)
+	}
+	return entries, next, nil
+}
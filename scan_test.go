@@ -0,0 +1,51 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroup_Keys(t *testing.T) {
+	node := NewNode()
+	g := node.NewGroup("scan", 0, RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	for _, key := range []string{"b/2", "a/1", "b/1", "b/3", "c/1"} {
+		if _, err := g.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, next := g.Keys("b/", 2, "")
+	if !reflect.DeepEqual(keys, []string{"b/1", "b/2"}) || next != "b/2" {
+		t.Fatalf("first page = %v, next %q", keys, next)
+	}
+	keys, next = g.Keys("b/", 2, next)
+	if !reflect.DeepEqual(keys, []string{"b/3"}) || next != "" {
+		t.Fatalf("second page = %v, next %q", keys, next)
+	}
+
+	entries, _ := g.Entries("a/", 0, "")
+	if len(entries) != 1 || entries[0].Size != g.CacheStats().Bytes/5 || entries[0].Age < entries[0].Idle {
+		t.Fatalf("entries = %+v", entries)
+	}
+
+	// 旧代数的记录不会被列出
+	g.BumpGeneration("c/")
+	if keys, _ := g.Keys("c/", 0, ""); len(keys) != 0 {
+		t.Fatalf("stale generation listed: %v", keys)
+	}
+
+	// Range 中可以删除记录
+	g.Range("b/", func(e EntryInfo) bool {
+		g.Remove(e.Key)
+		return true
+	})
+	if keys, _ := g.Keys("", 0, ""); !reflect.DeepEqual(keys, []string{"a/1"}) {
+		t.Fatalf("keys after prefix removal = %v", keys)
+	}
+}
@@ -6,18 +6,20 @@ package peanutcache
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/peanutzhen/peanutcache/consistenthash"
 	pb "github.com/peanutzhen/peanutcache/peanutcachepb"
 	"github.com/peanutzhen/peanutcache/registry"
 	"log"
 	"net"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
 // server 模块为peanutcache之间提供通信能力
@@ -25,8 +27,11 @@ import (
 // 至于找哪台主机 那是一致性哈希的工作了
 
 const (
-	defaultAddr     = "127.0.0.1:6324"
-	defaultReplicas = 50
+	defaultAddr      = "127.0.0.1:6324"
+	defaultReplicas  = 50
+	serviceName      = "peanutcache"
+	resyncInterval   = time.Second // 两次重新同步peers的最小间隔
+	defaultChunkSize = 1 << 20     // GetStream每段的大小 需小于gRPC消息大小限制
 )
 
 var (
@@ -34,100 +39,374 @@ var (
 		Endpoints:   []string{"localhost:2379"},
 		DialTimeout: 5 * time.Second,
 	}
+
+	defaultRegistryOnce sync.Once
+	defaultRegistry     registry.Registry
+	defaultRegistryErr  error
 )
 
+// getDefaultRegistry 返回连接默认etcd的 Registry 全进程共享同一个etcd client
+func getDefaultRegistry() (registry.Registry, error) {
+	defaultRegistryOnce.Do(func() {
+		defaultRegistry, defaultRegistryErr = registry.NewEtcd(defaultEtcdConfig)
+	})
+	return defaultRegistry, defaultRegistryErr
+}
+
 // server 和 Group 是解耦合的 所以server要自己实现并发控制
 type server struct {
 	pb.UnimplementedPeanutCacheServer
 
+	node       *Node      // server 为该节点内的 Group 提供服务
 	addr       string     // format: ip:port
 	status     bool       // true: running false: stop
 	stopSignal chan error // 通知registry revoke服务
 	mu         sync.Mutex
-	consHash   *consistenthash.Consistency
-	clients    map[string]*client
+	peers      *peerPicker
+	lastResync time.Time // 上一次因哈希环版本不一致而重新同步peers的时间
+
+	registry  registry.Registry   // 服务注册与发现 默认使用etcd
+	peerWatch bool                // 是否根据registry自动更新peers
+	dialOpts  []grpc.DialOption   // 连接peer的选项
+	grpcOpts  []grpc.ServerOption // 创建grpc server的选项
+	chunkSize int                 // GetStream每段的大小
+}
+
+// ServerOption 配置server的可选项
+type ServerOption func(*server)
+
+// WithRegistry 指定server注册服务以及发现peer所用的 registry.Registry
+func WithRegistry(r registry.Registry) ServerOption {
+	return func(s *server) {
+		s.registry = r
+	}
+}
+
+// WithPeerWatch 让server监听registry中的peanutcache服务
+// 节点加入或离开时自动更新一致性哈希 无需手动调用 SetPeers
+func WithPeerWatch() ServerOption {
+	return func(s *server) {
+		s.peerWatch = true
+	}
+}
+
+// WithDialOptions 为server连接peer追加grpc选项
+func WithDialOptions(opts ...grpc.DialOption) ServerOption {
+	return func(s *server) {
+		s.dialOpts = append(s.dialOpts, opts...)
+	}
+}
+
+// WithGRPCServerOptions 为server内部的grpc server追加选项 例如拦截器
+func WithGRPCServerOptions(opts ...grpc.ServerOption) ServerOption {
+	return func(s *server) {
+		s.grpcOpts = append(s.grpcOpts, opts...)
+	}
+}
+
+// WithMaxMsgSize 设置server与peer之间收发gRPC消息的最大字节数
+// 作用于server内部的grpc server以及连接peer的client 默认为gRPC的4MB
+// 更大的value可以通过 GetStream 分段获取 无需调大此值
+func WithMaxMsgSize(n int) ServerOption {
+	return func(s *server) {
+		s.grpcOpts = append(s.grpcOpts, grpc.MaxRecvMsgSize(n), grpc.MaxSendMsgSize(n))
+		s.dialOpts = append(s.dialOpts, grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(n), grpc.MaxCallSendMsgSize(n)))
+	}
+}
+
+// WithChunkSize 设置 GetStream 每段的字节数 默认为1MB
+func WithChunkSize(n int) ServerOption {
+	return func(s *server) {
+		if n > 0 {
+			s.chunkSize = n
+		}
+	}
 }
 
-// NewServer 创建cache的svr 若addr为空 则使用defaultAddr
-func NewServer(addr string) (*server, error) {
+// NewServer 为默认节点创建cache的svr 若addr为空 则使用defaultAddr
+func NewServer(addr string, opts ...ServerOption) (*server, error) {
+	return defaultNode.NewServer(addr, opts...)
+}
+
+func newServer(node *Node, addr string, opts ...ServerOption) (*server, error) {
 	if addr == "" {
 		addr = defaultAddr
 	}
 	if !validPeerAddr(addr) {
-		return nil, fmt.Errorf("invalid addr %s, it should be x.x.x.x:port", addr)
+		return nil, fmt.Errorf("invalid addr %s, it should be host:port", addr)
+	}
+	s := &server{node: node, addr: addr, chunkSize: defaultChunkSize}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// getRegistry 返回server使用的 Registry
+func (s *server) getRegistry() (registry.Registry, error) {
+	if s.registry != nil {
+		return s.registry, nil
+	}
+	return getDefaultRegistry()
+}
+
+// newClient 创建通过server的 Registry 访问peerAddr的client
+func (s *server) newClient(peerAddr string) *client {
+	return &client{
+		name:     fmt.Sprintf("%s/%s", serviceName, peerAddr),
+		addr:     peerAddr,
+		self:     s.addr,
+		registry: s.registry,
+		dialOpts: s.dialOpts,
+		ring:     s,
+
+		compressor: s.compressorFor,
+	}
+}
+
+// compressorFor 返回获取group时使用的gRPC compressor名称
+// 由本节点该 Group 的 WithCompression 决定 peer将用同一compressor回复
+func (s *server) compressorFor(group string) string {
+	g := s.node.GetGroup(group)
+	if g == nil {
+		return ""
 	}
-	return &server{addr: addr}, nil
+	return grpcCompressorName(g.cache.codec)
 }
 
 // Get 实现PeanutCache service的Get接口
 func (s *server) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
-	group, key := in.GetGroup(), in.GetKey()
 	resp := &pb.GetResponse{}
+	grpc.SetHeader(ctx, s.header())
+	view, err := s.lookup(ctx, in)
+	if err != nil {
+		return resp, toStatus(err)
+	}
+	// 响应只会被序列化 不会被修改 因此直接引用缓存中的value 不需要复制
+	resp.Value = view.bytes()
+	return resp, nil
+}
+
+// GetStream 实现PeanutCache service的GetStream接口
+// value按chunkSize分段发送 第一段携带value的总长度
+func (s *server) GetStream(in *pb.GetRequest, stream pb.PeanutCache_GetStreamServer) error {
+	stream.SetHeader(s.header())
+	view, err := s.lookup(stream.Context(), in)
+	if err != nil {
+		return toStatus(err)
+	}
+	// 每一段都只会被序列化 直接引用缓存中的value
+	b := view.bytes()
+	size := int64(len(b))
+	// 空value也需要发送一段 告知接收方长度为0
+	for first := true; first || len(b) > 0; first = false {
+		n := len(b)
+		if n > s.chunkSize {
+			n = s.chunkSize
+		}
+		chunk := &pb.GetChunk{Data: b[:n]}
+		if first {
+			chunk.Size = size
+		}
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// Lease 实现PeanutCache service的Lease接口
+func (s *server) Lease(ctx context.Context, in *pb.LeaseRequest) (*pb.LeaseResponse, error) {
+	if in.GetKey() == "" {
+		return &pb.LeaseResponse{}, toStatus(ErrKeyRequired)
+	}
+	g := s.node.GetGroup(in.GetGroup())
+	if g == nil {
+		return &pb.LeaseResponse{}, toStatus(fmt.Errorf("%w: %s", ErrGroupNotFound, in.GetGroup()))
+	}
+	value, found, granted := g.leaseFor(in.GetKey(), in.GetHolder())
+	resp := &pb.LeaseResponse{Found: found, Granted: granted}
+	if found {
+		resp.Value = value.bytes()
+	}
+	return resp, nil
+}
+
+// Fill 实现PeanutCache service的Fill接口
+func (s *server) Fill(ctx context.Context, in *pb.FillRequest) (*pb.FillResponse, error) {
+	if in.GetKey() == "" {
+		return &pb.FillResponse{}, toStatus(ErrKeyRequired)
+	}
+	g := s.node.GetGroup(in.GetGroup())
+	if g == nil {
+		return &pb.FillResponse{}, toStatus(fmt.Errorf("%w: %s", ErrGroupNotFound, in.GetGroup()))
+	}
+	if in.GetRelease() {
+		g.releaseFrom(in.GetKey(), in.GetHolder())
+		return &pb.FillResponse{}, nil
+	}
+	if err := g.fillFrom(in.GetKey(), in.GetHolder(), in.GetValue()); err != nil {
+		return &pb.FillResponse{}, toStatus(err)
+	}
+	return &pb.FillResponse{}, nil
+}
+
+// Bump 实现PeanutCache service的Bump接口
+func (s *server) Bump(ctx context.Context, in *pb.BumpRequest) (*pb.BumpResponse, error) {
+	g := s.node.GetGroup(in.GetGroup())
+	if g == nil {
+		return &pb.BumpResponse{}, toStatus(fmt.Errorf("%w: %s", ErrGroupNotFound, in.GetGroup()))
+	}
+	g.setGeneration(in.GetPrefix(), in.GetGeneration())
+	return &pb.BumpResponse{}, nil
+}
+
+// Scan 实现PeanutCache service的Scan接口 只列出本节点的记录
+func (s *server) Scan(ctx context.Context, in *pb.ScanRequest) (*pb.ScanResponse, error) {
+	g := s.node.GetGroup(in.GetGroup())
+	if g == nil {
+		return &pb.ScanResponse{}, toStatus(fmt.Errorf("%w: %s", ErrGroupNotFound, in.GetGroup()))
+	}
+	entries, next := g.Entries(in.GetPrefix(), int(in.GetLimit()), in.GetCursor())
+	resp := &pb.ScanResponse{Next: next, Entries: make([]*pb.ScanEntry, len(entries))}
+	for i, e := range entries {
+		resp.Entries[i] = &pb.ScanEntry{
+			Key:  e.Key,
+			Size: e.Size,
+			Age:  int64(e.Age),
+			Idle: int64(e.Idle),
+		}
+	}
+	return resp, nil
+}
+
+// header 返回回复peer的metadata 其中包括自己哈希环的版本
+func (s *server) header() metadata.MD {
+	return metadata.Pairs(mdRingVersion, strconv.FormatUint(s.ringVersion(), 10))
+}
+
+// lookup 处理来自peer的请求 Get与GetStream共用
+func (s *server) lookup(ctx context.Context, in *pb.GetRequest) (ByteView, error) {
+	group, key := in.GetGroup(), in.GetKey()
 
 	log.Printf("[peanutcache_svr %s] Recv RPC Request - (%s)/(%s)", s.addr, group, key)
+	// 已被转发过的请求只从本地获取 避免哈希环不一致时请求在节点间来回转发
+	forward := true
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if hops, ok := mdUint(md, mdHops); ok && hops >= maxHops {
+			forward = false
+		}
+		if version, ok := mdUint(md, mdRingVersion); ok && version != 0 && version != s.ringVersion() {
+			from := "unknown"
+			if p, ok := peer.FromContext(ctx); ok {
+				from = p.Addr.String()
+			}
+			s.ringMismatch(from, version)
+		}
+	}
 	if key == "" {
-		return resp, fmt.Errorf("key required")
+		return ByteView{}, ErrKeyRequired
 	}
-	g := GetGroup(group)
+	g := s.node.GetGroup(group)
 	if g == nil {
-		return resp, fmt.Errorf("group not found")
+		return ByteView{}, fmt.Errorf("%w: %s", ErrGroupNotFound, group)
 	}
-	view, err := g.Get(key)
+	g.Stats.ServerRequests.Add(1)
+	return g.get(key, in.GetGeneration(), forward)
+}
+
+// Start 在addr对应的tcp端口上启动cache服务
+func (s *server) Start() error {
+	s.mu.Lock()
+	running := s.status
+	s.mu.Unlock()
+	if running {
+		return fmt.Errorf("server already started")
+	}
+	_, port, err := net.SplitHostPort(s.addr)
 	if err != nil {
-		return resp, err
+		return fmt.Errorf("invalid addr %s: %v", s.addr, err)
 	}
-	resp.Value = view.ByteSlice()
-	return resp, nil
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	return s.Serve(lis)
 }
 
-// Start 启动cache服务
-func (s *server) Start() error {
+// Serve 在给定的listener上启动cache服务
+// Serve将不会return 除非服务stop或者抛出error
+func (s *server) Serve(lis net.Listener) error {
 	s.mu.Lock()
 	if s.status == true {
 		s.mu.Unlock()
+		lis.Close()
 		return fmt.Errorf("server already started")
 	}
 	// -----------------启动服务----------------------
 	// 1. 设置status为true 表示服务器已在运行
 	// 2. 初始化stop channal,这用于通知registry stop keep alive
-	// 3. 初始化tcp socket并开始监听
-	// 4. 注册rpc服务至grpc 这样grpc收到request可以分发给server处理
-	// 5. 将自己的服务名/Host地址注册至etcd 这样client可以通过etcd
-	//    获取服务Host地址 从而进行通信。这样的好处是client只需知道服务名
-	//    以及etcd的Host即可获取对应服务IP 无需写死至client代码中
+	// 3. 注册rpc服务至grpc 这样grpc收到request可以分发给server处理
+	// 4. 将自己的服务名/Host地址注册至registry(默认etcd) 这样client可以
+	//    通过registry获取服务Host地址 从而进行通信。这样的好处是client只需
+	//    知道服务名以及registry即可获取对应服务IP 无需写死至client代码中
 	// ----------------------------------------------
 	s.status = true
-	s.stopSignal = make(chan error)
+	// 有1个缓冲 注册尚未完成或已失败时 Stop 不会阻塞
+	s.stopSignal = make(chan error, 1)
 
-	port := strings.Split(s.addr, ":")[1]
-	lis, err := net.Listen("tcp", ":"+port)
-	if err != nil {
-		return fmt.Errorf("failed to listen: %v", err)
-	}
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(s.grpcOpts...)
 	pb.RegisterPeanutCacheServer(grpcServer, s)
 
-	// 注册服务至etcd
+	// 注册服务至registry 注册可能耗时较长(例如etcd不可达) 因此不阻塞服务启动
+	// 只读的registry(例如DNS)由外部维护地址 跳过自身的注册
+	// 其他注册错误将停止服务 并由Serve返回
+	regErr := make(chan error, 1)
 	go func() {
-		// Register never return unless stop singnal received
-		err := registry.Register("peanutcache", s.addr, s.stopSignal)
+		reg, err := s.getRegistry()
+		if err == nil {
+			if err = reg.Register(serviceName, s.addr); errors.Is(err, registry.ErrReadOnly) {
+				err = nil
+			}
+		}
 		if err != nil {
-			log.Fatalf(err.Error())
+			regErr <- err
+			grpcServer.Stop()
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if s.peerWatch {
+			go s.watchPeers(ctx, reg)
+		}
+		// 等待停止信号 撤销服务
+		if err := <-s.stopSignal; err != nil {
+			log.Println(err)
+		}
+		cancel()
+		if err := reg.Deregister(serviceName, s.addr); err != nil && !errors.Is(err, registry.ErrReadOnly) {
+			log.Println(err)
 		}
 		// Close channel
 		close(s.stopSignal)
-		// Close tcp listen
-		err = lis.Close()
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
+		// Close listener and connections
+		grpcServer.Stop()
 		log.Printf("[%s] Revoke service and close tcp socket ok.", s.addr)
 	}()
 
-	//log.Printf("[%s] register service ok\n", s.addr)
 	s.mu.Unlock()
 
-	if err := grpcServer.Serve(lis); s.status && err != nil {
+	err := grpcServer.Serve(lis)
+	select {
+	case err := <-regErr:
+		s.mu.Lock()
+		s.status = false
+		s.mu.Unlock()
+		return fmt.Errorf("failed to register %s: %w", s.addr, err)
+	default:
+	}
+	if err != nil {
 		return fmt.Errorf("failed to serve: %v", err)
 	}
 	return nil
@@ -136,37 +415,118 @@ func (s *server) Start() error {
 // SetPeers 将各个远端主机IP配置到Server里
 // 这样Server就可以Pick他们了
 // 注意: 此操作是*覆写*操作！
-// 注意: peersIP必须满足 x.x.x.x:port的格式
+// 注意: peersIP必须满足 host:port的格式
 func (s *server) SetPeers(peersAddr ...string) {
+	peers := newPeerPicker(s.addr, s.newClient, peersAddr...)
+	s.mu.Lock()
+	s.peers = peers
+	s.mu.Unlock()
+}
+
+// watchPeers 根据registry中peanutcache服务的变化更新peers
+func (s *server) watchPeers(ctx context.Context, reg registry.Registry) {
+	ch, err := reg.Watch(ctx, serviceName)
+	if err != nil {
+		log.Printf("[%s] watch peers failed: %v", s.addr, err)
+		return
+	}
+	for addrs := range ch {
+		if ctx.Err() != nil {
+			return
+		}
+		s.setValidPeers(addrs)
+	}
+}
+
+// RingVersion 返回server哈希环的版本 尚未设置peers时为0
+func (s *server) RingVersion() uint64 {
+	return s.ringVersion()
+}
+
+func (s *server) ringVersion() uint64 {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.consHash = consistenthash.New(defaultReplicas, nil)
-	s.consHash.Register(peersAddr...)
-	s.clients = make(map[string]*client)
-	for _, peerAddr := range peersAddr {
-		if !validPeerAddr(peerAddr) {
-			panic(fmt.Sprintf("[peer %s] invalid address format, it should be x.x.x.x:port", peerAddr))
+	peers := s.peers
+	s.mu.Unlock()
+	if peers == nil {
+		return 0
+	}
+	return peers.version()
+}
+
+// ringMismatch 在peer的哈希环版本与自己不一致时被调用
+// 若peers由registry维护 则重新从registry同步peers 同步至多每 resyncInterval 一次
+func (s *server) ringMismatch(peer string, version uint64) {
+	log.Printf("[%s] ring version mismatch with %s: %d(local) %d(peer)", s.addr, peer, s.ringVersion(), version)
+	if !s.peerWatch {
+		return
+	}
+	s.mu.Lock()
+	if !s.status || time.Since(s.lastResync) < resyncInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastResync = time.Now()
+	s.mu.Unlock()
+	go s.resync()
+}
+
+// resync 从registry重新同步peers
+func (s *server) resync() {
+	reg, err := s.getRegistry()
+	if err != nil {
+		log.Printf("[%s] resync peers failed: %v", s.addr, err)
+		return
+	}
+	addrs, err := reg.Resolve(serviceName)
+	if err != nil {
+		log.Printf("[%s] resync peers failed: %v", s.addr, err)
+		return
+	}
+	s.setValidPeers(addrs)
+}
+
+// setValidPeers 忽略格式错误的地址后 SetPeers
+func (s *server) setValidPeers(addrs []string) {
+	peers := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if validPeerAddr(addr) {
+			peers = append(peers, addr)
 		}
-		service := fmt.Sprintf("peanutcache/%s", peerAddr)
-		s.clients[peerAddr] = NewClient(service)
 	}
+	log.Printf("[%s] peers changed: %v", s.addr, peers)
+	s.SetPeers(peers...)
+}
+
+// NewPicker 创建一个只在peersAddr之间选择的 Picker
+// 它独立于server自身的peers 可以让 Group 只分布在部分节点上
+// 注意: peersAddr必须满足 host:port的格式
+func (s *server) NewPicker(peersAddr ...string) Picker {
+	return newPeerPicker(s.addr, s.newClient, peersAddr...)
 }
 
-// Pick 根据一致性哈希选举出key应存放在的cache
+// Pick 根据server的peers选举出key应存放在的cache
 // return false 代表从本地获取cache
 func (s *server) Pick(key string) (Fetcher, bool) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	peers := s.peers
+	s.mu.Unlock()
 
-	peerAddr := s.consHash.GetPeer(key)
-	// Pick itself
-	if peerAddr == s.addr {
-		log.Printf("ooh! pick myself, I am %s\n", s.addr)
+	// 尚未设置peers或server已停止
+	if peers == nil {
 		return nil, false
 	}
-	log.Printf("[cache %s] pick remote peer: %s\n", s.addr, peerAddr)
-	return s.clients[peerAddr], true
+	return peers.Pick(key)
+}
+
+// peerFetchers 返回server当前的全部peer 不包括自身
+func (s *server) peerFetchers() []Fetcher {
+	s.mu.Lock()
+	peers := s.peers
+	s.mu.Unlock()
+	if peers == nil {
+		return nil
+	}
+	return peers.peerFetchers()
 }
 
 // Stop 停止server运行 如果server没有运行 这将是一个no-op
@@ -177,9 +537,8 @@ func (s *server) Stop() {
 		return
 	}
 	s.stopSignal <- nil // 发送停止keepalive信号
-	s.status = false // 设置server运行状态为stop
-	s.clients = nil // 清空一致性哈希信息 有助于垃圾回收
-	s.consHash = nil
+	s.status = false    // 设置server运行状态为stop
+	s.peers = nil       // 清空一致性哈希信息 有助于垃圾回收
 	s.mu.Unlock()
 }
 
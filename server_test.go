@@ -5,22 +5,32 @@
 package peanutcache
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	pb "github.com/peanutzhen/peanutcache/peanutcachepb"
+	"github.com/peanutzhen/peanutcache/registry"
 	"log"
 	"math/rand"
+	"net"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
+
+	"google.golang.org/grpc"
 )
 
-func createTestSvr() (*Group, *server) {
+func createTestSvr() (*Node, *Group, *server) {
 	mysql := map[string]string{
 		"Tom":  "630",
 		"Jack": "589",
 		"Sam":  "567",
 	}
 
-	g := NewGroup("scores", 2<<10, RetrieverFunc(
+	node := NewNode()
+	g := node.NewGroup("scores", 2<<10, RetrieverFunc(
 		func(key string) ([]byte, error) {
 			log.Println("[Mysql] search key", key)
 			if v, ok := mysql[key]; ok {
@@ -34,17 +44,17 @@ func createTestSvr() (*Group, *server) {
 	port := 50000 + r.Intn(100)
 	addr := fmt.Sprintf("localhost:%d", port)
 
-	svr, err := NewServer(addr)
+	svr, err := node.NewServer(addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 	svr.SetPeers(addr)
 	g.RegisterSvr(svr)
-	return g, svr
+	return node, g, svr
 }
 
 func TestServer_GetExistsKey(t *testing.T) {
-	g, svr := createTestSvr()
+	node, g, svr := createTestSvr()
 	go func() {
 		err := svr.Start()
 		if err != nil {
@@ -59,11 +69,12 @@ func TestServer_GetExistsKey(t *testing.T) {
 		t.Errorf("Tom %s(actual)/%s(ok)", view.String(), "630")
 	}
 	log.Printf("Tom -> %s", view.String())
-	DestroyGroup(g.name)
+	node.DestroyGroup(g.name)
+	node.Stop()
 }
 
 func TestServer_GetUnknownKey(t *testing.T) {
-	g, svr := createTestSvr()
+	node, g, svr := createTestSvr()
 	go func() {
 		err := svr.Start()
 		if err != nil {
@@ -78,5 +89,162 @@ func TestServer_GetUnknownKey(t *testing.T) {
 			t.Log(err.Error())
 		}
 	}
-	DestroyGroup(g.name)
+	node.DestroyGroup(g.name)
+	node.Stop()
+}
+
+func TestServer_MultiGroup(t *testing.T) {
+	node, scores, svr := createTestSvr()
+	ages := node.NewGroup("ages", 2<<10, RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return []byte("21"), nil
+		}))
+	// ages 只在本地填充缓存 不使用server的peers
+	ages.RegisterPicker(NoPeerPicker{})
+
+	resp, err := svr.Get(context.Background(), &pb.GetRequest{Group: "ages", Key: "Tom"})
+	if err != nil || string(resp.GetValue()) != "21" {
+		t.Fatalf("ages/Tom = %s, %v", resp.GetValue(), err)
+	}
+	node.DestroyGroup(scores.name)
+	if _, err := svr.Get(context.Background(), &pb.GetRequest{Group: "scores", Key: "Tom"}); err == nil {
+		t.Fatal("destroyed group should not be served")
+	}
+	resp, err = svr.Get(context.Background(), &pb.GetRequest{Group: "ages", Key: "Jack"})
+	if err != nil || string(resp.GetValue()) != "21" {
+		t.Fatalf("destroying scores should not affect ages, got %s, %v", resp.GetValue(), err)
+	}
+}
+
+// brokenRegistry 的 Register 总是失败
+type brokenRegistry struct{ *registry.Static }
+
+func (brokenRegistry) Register(service string, addr string) error {
+	return errors.New("registry unavailable")
+}
+
+func TestServer_ReadOnlyRegistry(t *testing.T) {
+	node := NewNode()
+	svr, err := node.NewServer("localhost:0", WithRegistry(registry.NewDNS("cache.invalid", time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- svr.Serve(lis) }()
+	// 只读registry不应阻止服务启动
+	deadline := time.Now().Add(time.Second)
+	for {
+		svr.mu.Lock()
+		running := svr.status
+		svr.mu.Unlock()
+		if running {
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("Serve returned early: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	svr.Stop()
+	if err := <-done; err != nil {
+		t.Fatalf("Serve = %v after Stop", err)
+	}
+}
+
+func TestServer_RegisterError(t *testing.T) {
+	node := NewNode()
+	svr, err := node.NewServer("localhost:0", WithRegistry(brokenRegistry{registry.NewStatic()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svr.Serve(lis); err == nil || !strings.Contains(err.Error(), "registry unavailable") {
+		t.Fatalf("Serve = %v, want register error", err)
+	}
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	if svr.status {
+		t.Fatal("server should not be running after register failed")
+	}
+}
+
+func TestServer_SetValidPeersHostname(t *testing.T) {
+	svr, err := NewNode().NewServer("cache-0.cache.local:6324")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.setValidPeers([]string{"cache-0.cache.local:6324", "cache-1.cache.local:6324", "10.0.0.1:6324", "bad", ":6324", "host:port"})
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	var got []string
+	for addr := range svr.peers.clients {
+		got = append(got, addr)
+	}
+	sort.Strings(got)
+	want := []string{"10.0.0.1:6324", "cache-0.cache.local:6324", "cache-1.cache.local:6324"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("peers = %v, want %v", got, want)
+	}
+}
+
+// chunkServer 按chunks原样发送 GetStream 的响应 模拟异常的peer
+type chunkServer struct {
+	pb.UnimplementedPeanutCacheServer
+	chunks []*pb.GetChunk
+}
+
+func (s *chunkServer) GetStream(in *pb.GetRequest, stream pb.PeanutCache_GetStreamServer) error {
+	for _, chunk := range s.chunks {
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestClient_FetchStreamInvalidSize(t *testing.T) {
+	tests := map[string][]*pb.GetChunk{
+		"negative size": {{Size: -1, Data: []byte("abc")}},
+		"huge size":     {{Size: 1 << 62, Data: []byte("abc")}},
+		"too long":      {{Size: 2, Data: []byte("abc")}},
+		"too short":     {{Size: 4, Data: []byte("ab")}, {Data: []byte("c")}},
+	}
+	tests["valid"] = []*pb.GetChunk{{Size: 3, Data: []byte("ab")}, {Data: []byte("c")}}
+	for name, chunks := range tests {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		grpcServer := grpc.NewServer()
+		pb.RegisterPeanutCacheServer(grpcServer, &chunkServer{chunks: chunks})
+		go grpcServer.Serve(lis)
+		conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _, err := (&client{}).fetchStream(context.Background(), pb.NewPeanutCacheClient(conn), &pb.GetRequest{Group: "scores", Key: "Tom"})
+		conn.Close()
+		grpcServer.Stop()
+		if name == "valid" {
+			if err != nil || string(value) != "abc" {
+				t.Fatalf("valid: got %q, %v", value, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("%s: should be rejected, got %d bytes", name, len(value))
+		}
+	}
 }
@@ -5,6 +5,10 @@
 package singlefilght
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
 	"sync"
 )
 
@@ -15,10 +19,32 @@ import (
 // 这个flight只会起飞一次(single) 这样就可以缓解击穿的可能性
 // flight载有我们要的缓存数据 称为packet
 
+// errGoexit 表示fn调用了runtime.Goexit
+var errGoexit = errors.New("singlefilght: fn called runtime.Goexit")
+
+// PanicError 是fn panic时传递给等待者的错误 包含panic的值与fn的调用栈
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("singlefilght: fn panicked: %v\n\n%s", p.Value, p.Stack)
+}
+
+// Result 是 FlyChan 返回的结果
+type Result struct {
+	Val    interface{}
+	Err    error
+	Shared bool // 结果是否被多个调用方共享
+}
+
 type packet struct {
-	wg  sync.WaitGroup
-	val interface{}
-	err error
+	done  chan struct{} // fn完成后关闭
+	val   interface{}
+	err   error
+	panic *PanicError // fn panic时非空
+	dups  int         // 加入该航班的调用方个数(不包括发起者)
 }
 
 type Flight struct {
@@ -26,28 +52,111 @@ type Flight struct {
 	flight map[string]*packet
 }
 
-// Fly 负责key航班的飞行 fn是获取packet的方法
-func (f *Flight) Fly(key string, fn func() (interface{}, error)) (interface{}, error) {
+// join 加入key对应的航班 不存在时创建新航班 leader表示是否由调用方负责起飞
+func (f *Flight) join(key string) (p *packet, leader bool) {
 	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.flight == nil {
 		f.flight = make(map[string]*packet)
 	}
 	if p, ok := f.flight[key]; ok {
-		f.mu.Unlock()
-		p.wg.Wait()
-		return p.val, p.err
+		p.dups++
+		return p, false
 	}
-	p := new(packet)
-	p.wg.Add(1)
+	p = &packet{done: make(chan struct{})}
 	f.flight[key] = p
-	f.mu.Unlock()
+	return p, true
+}
 
+// run 执行fn并记录结果 fn panic或调用runtime.Goexit时也会结束航班
+func (f *Flight) run(key string, p *packet, fn func() (interface{}, error)) {
+	normalReturn := false
+	defer func() {
+		if !normalReturn && p.panic == nil {
+			p.err = errGoexit
+		}
+		f.mu.Lock()
+		if f.flight[key] == p { // 航班可能已被Forget
+			delete(f.flight, key) // 航班已完成
+		}
+		f.mu.Unlock()
+		close(p.done)
+	}()
+	defer func() {
+		if !normalReturn {
+			if r := recover(); r != nil {
+				p.panic = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}
+	}()
 	p.val, p.err = fn()
-	p.wg.Done()
+	normalReturn = true
+}
 
+// result 在航班完成后返回结果 fn panic时在调用方的goroutine中重新panic
+func (f *Flight) result(p *packet) (interface{}, error, bool) {
+	if p.panic != nil {
+		panic(p.panic)
+	}
 	f.mu.Lock()
-	delete(f.flight, key) // 航班已完成
+	shared := p.dups > 0
 	f.mu.Unlock()
+	return p.val, p.err, shared
+}
+
+// Fly 负责key航班的飞行 fn是获取packet的方法
+// fn panic时 发起者与所有等待者都会以 *PanicError panic
+func (f *Flight) Fly(key string, fn func() (interface{}, error)) (interface{}, error) {
+	p, leader := f.join(key)
+	if leader {
+		f.run(key, p, fn)
+	} else {
+		<-p.done
+	}
+	v, err, _ := f.result(p)
+	return v, err
+}
 
-	return p.val, p.err
+// FlyContext 与 Fly 相同 但每个调用方都可以通过ctx放弃等待
+// 放弃等待的调用方返回ctx.Err() fn仍会继续执行 其结果交给其他调用方
+// shared表示结果是否被多个调用方共享
+func (f *Flight) FlyContext(ctx context.Context, key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	p, leader := f.join(key)
+	if leader {
+		go f.run(key, p, fn)
+	}
+	select {
+	case <-p.done:
+		return f.result(p)
+	case <-ctx.Done():
+		return nil, ctx.Err(), false
+	}
+}
+
+// FlyChan 与 Fly 相同 但立即返回 结果在航班完成后发送到返回的channel
+// fn panic时 结果的Err为 *PanicError 而不会panic
+func (f *Flight) FlyChan(key string, fn func() (interface{}, error)) <-chan Result {
+	ch := make(chan Result, 1)
+	p, leader := f.join(key)
+	if leader {
+		go f.run(key, p, fn)
+	}
+	go func() {
+		<-p.done
+		if p.panic != nil {
+			ch <- Result{Err: p.panic}
+			return
+		}
+		_, _, shared := f.result(p)
+		ch <- Result{Val: p.val, Err: p.err, Shared: shared}
+	}()
+	return ch
+}
+
+// Forget 让之后对key的调用发起新的航班 而不是加入正在飞行的航班
+// 已加入的调用方仍会得到原航班的结果
+func (f *Flight) Forget(key string) {
+	f.mu.Lock()
+	delete(f.flight, key)
+	f.mu.Unlock()
 }
@@ -0,0 +1,146 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package singlefilght
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlight_Fly(t *testing.T) {
+	var f Flight
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "630", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := f.Fly("Tom", fn); err != nil || v != "630" {
+				t.Errorf("got %v, %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("fn called %d times, want 1", calls)
+	}
+}
+
+func TestFlight_FlyContext(t *testing.T) {
+	var f Flight
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		return "630", nil
+	}
+
+	// 发起者放弃等待 fn继续为其他调用方执行
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err, _ := f.FlyContext(ctx, "Tom", fn); err != context.DeadlineExceeded {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v, err, shared := f.FlyContext(context.Background(), "Tom", fn)
+		if err != nil || v != "630" || !shared {
+			t.Errorf("got %v, %v, shared=%v", v, err, shared)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	<-done
+
+	// 只有一个调用方时结果未被共享
+	if _, _, shared := f.FlyContext(context.Background(), "Jack", func() (interface{}, error) {
+		return "589", nil
+	}); shared {
+		t.Fatal("single caller should not be shared")
+	}
+}
+
+func TestFlight_Forget(t *testing.T) {
+	var f Flight
+	var calls int32
+	release := make(chan struct{})
+	first := f.FlyChan("Tom", func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "old", nil
+	})
+	time.Sleep(10 * time.Millisecond)
+	f.Forget("Tom")
+
+	v, err := f.Fly("Tom", func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return "new", nil
+	})
+	if err != nil || v != "new" {
+		t.Fatalf("forgotten key should start a new flight, got %v", v)
+	}
+	close(release)
+	if r := <-first; r.Val != "old" || r.Shared {
+		t.Fatalf("first flight got %+v", r)
+	}
+	if calls != 2 {
+		t.Fatalf("fn called %d times, want 2", calls)
+	}
+}
+
+func TestFlight_Panic(t *testing.T) {
+	var f Flight
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		panic("mysql crashed")
+	}
+
+	var wg sync.WaitGroup
+	var panics int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					if pe, ok := r.(*PanicError); ok && pe.Value == "mysql crashed" {
+						atomic.AddInt32(&panics, 1)
+					}
+				}
+			}()
+			f.Fly("Tom", fn)
+		}()
+	}
+	ch := f.FlyChan("Tom", fn)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if panics != 5 {
+		t.Fatalf("%d callers saw the panic, want 5", panics)
+	}
+	var pe *PanicError
+	if r := <-ch; !errors.As(r.Err, &pe) {
+		t.Fatalf("FlyChan should get a *PanicError, got %v", r.Err)
+	}
+
+	// panic后航班已结束 之后的调用会重新起飞
+	if v, err := f.Fly("Tom", func() (interface{}, error) { return "630", nil }); err != nil || v != "630" {
+		t.Fatalf("got %v, %v after panic", v, err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// stats 模块记录 Group 的运行统计 所有计数器均可并发更新
+
+// AtomicInt 是可以并发读写的int64计数器
+type AtomicInt int64
+
+// Add 原子地增加n
+func (i *AtomicInt) Add(n int64) {
+	atomic.AddInt64((*int64)(i), n)
+}
+
+// Get 原子地读取当前值
+func (i *AtomicInt) Get() int64 {
+	return atomic.LoadInt64((*int64)(i))
+}
+
+func (i *AtomicInt) String() string {
+	return strconv.FormatInt(i.Get(), 10)
+}
+
+// Stats 是 Group 的统计信息
+type Stats struct {
+	Gets           AtomicInt // 所有Get请求 包括来自peer的请求
+	CacheHits      AtomicInt // 命中本地缓存的次数
+	StaleHits      AtomicInt // 命中过时value的次数 每次都会触发后台刷新
+	DiskHits       AtomicInt // 内存未命中但命中磁盘层的次数
+	RefreshErrs    AtomicInt // 后台刷新失败的次数
+	NegativeHits   AtomicInt // 命中负缓存的次数
+	FilterRejects  AtomicInt // 被布隆过滤器拒绝的次数
+	Loads          AtomicInt // 缓存未命中 (去重前)
+	LoadsDeduped   AtomicInt // 经过singleflight去重后实际发生的加载
+	PeerLoads      AtomicInt // 从peer成功获取的次数
+	PeerErrors     AtomicInt // 从peer获取失败的次数
+	LocalLoads     AtomicInt // 从本地Retriever成功获取的次数
+	LocalLoadErrs  AtomicInt // 从本地Retriever获取失败的次数
+	BatchLoads     AtomicInt // 向 BatchRetriever 发起批量获取的次数
+	LeaseWaits     AtomicInt // 等待其他节点填充的轮询次数
+	ServerRequests AtomicInt // 来自peer的请求数
+	Bounces        AtomicInt // 被转发到本节点 但本节点哈希环认为属于其他peer的请求数
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/peanutzhen/peanutcache/disk"
+)
+
+// tier 模块将内存缓存因容量淘汰的记录写入磁盘层
+// 内存未命中时先查询磁盘层 命中后移回内存 之后才访问peer或 Retriever
+// 同一个key只会在内存或磁盘中的一层 写入新value或删除key时磁盘层的记录也被删除
+
+// WithDiskTier 为 Group 启用磁盘层 s的容量与淘汰由 disk.Store 自己管理
+// s由应用打开与关闭 每个 Group 应使用单独的目录
+// 移回内存的记录保留原来的hard TTL soft TTL重新计算
+func WithDiskTier(s *disk.Store) GroupOption {
+	return func(g *Group) {
+		g.cache.tier = s
+	}
+}
+
+// spill 将因容量淘汰的记录写入磁盘层 在释放c.mu后调用
+func (c *cache) spill(e evicted) {
+	if err := c.tier.Put(e.key, e.value.bytes(), e.hard); err != nil {
+		log.Printf("spill %s to disk failed: %v", e.key, err)
+	}
+}
+
+// getTier 从磁盘层读取key 命中时将其移回内存
+func (c *cache) getTier(key string) (ByteView, bool) {
+	if c.tier == nil {
+		return ByteView{}, false
+	}
+	b, hard, err := c.tier.Get(key)
+	if errors.Is(err, disk.ErrNotFound) {
+		return ByteView{}, false
+	}
+	if err != nil {
+		log.Printf("read %s from disk failed: %v", key, err)
+		c.dropTier(key)
+		return ByteView{}, false
+	}
+	// 先从磁盘层删除 value过大时移回内存后会被立即淘汰并重新写入磁盘层
+	c.dropTier(key)
+	value := ByteView{b: b}
+	c.promote(key, value, hard)
+	return value, true
+}
+
+// promote 将磁盘层的value移回内存 内存中已有更新的value时放弃
+func (c *cache) promote(key string, value ByteView, hard time.Time) {
+	c.mu.Lock()
+	if _, ok := c.lruLocked().Peek(key); ok {
+		c.unlock()
+		return
+	}
+	c.putLocked(key, value, hard)
+	c.unlock()
+	if c.budget != nil {
+		c.budget.enforce()
+	}
+}
+
+// dropTier 删除磁盘层中的key 返回key是否在磁盘层中
+func (c *cache) dropTier(key string) bool {
+	if c.tier == nil {
+		return false
+	}
+	if !c.tier.Has(key) {
+		return false
+	}
+	if err := c.tier.Delete(key); err != nil {
+		log.Printf("delete %s from disk failed: %v", key, err)
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/peanutzhen/peanutcache/disk"
+	"github.com/peanutzhen/peanutcache/lru"
+)
+
+func TestGroup_DiskTier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peanutcache-tier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := disk.Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	loads := make(map[string]int)
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		loads[key]++
+		return []byte("v" + key), nil
+	})
+	node := NewNode()
+	// 容量只够存放一条记录
+	g := node.NewGroup("tier", int64(len("k0")+len("vk0")+entryOverhead)+lru.EntryOverhead, retriever, WithDiskTier(store))
+	for _, key := range []string{"k0", "k1", "k0", "k1"} {
+		v, err := g.Get(key)
+		if err != nil || v.String() != "v"+key {
+			t.Fatalf("get %s = %q, %v", key, v.String(), err)
+		}
+	}
+	if loads["k0"] != 1 || loads["k1"] != 1 {
+		t.Fatalf("evicted keys should be served from disk, loads %v", loads)
+	}
+	if hits := g.Stats.DiskHits.Get(); hits != 2 {
+		t.Fatalf("disk hits = %d, want 2", hits)
+	}
+	// 每个key只在一层中
+	if store.Len() != 1 {
+		t.Fatalf("disk holds %d keys, want 1", store.Len())
+	}
+
+	// 新value使磁盘中的旧value失效
+	g.populateCache("k0", ByteView{b: []byte("new")})
+	if v, _ := g.Get("k0"); v.String() != "new" {
+		t.Fatalf("k0 = %q after update", v.String())
+	}
+	if !g.Remove("k0") || !g.Remove("k1") {
+		t.Fatal("remove should report keys in memory or on disk")
+	}
+	if store.Len() != 0 {
+		t.Fatalf("disk holds %d keys after remove", store.Len())
+	}
+}
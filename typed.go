@@ -0,0 +1,135 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/peanutzhen/peanutcache/lru"
+)
+
+// typed 模块在 Group 之上提供以Go对象读写缓存的能力
+// 数据源返回的对象由 EncodeRetriever 编码后缓存 Typed 在 Get 时解码
+// 调用方不再需要在 Group.Get 前后手动序列化
+// 启用memo后 解码后的对象会被保留 value未改变时直接返回 避免重复解码
+
+// EncodeRetriever 返回使用c编码fn返回对象的 Retriever
+// fn返回的错误(例如 ErrNotFound)原样返回
+func EncodeRetriever(c Codec, fn func(key string) (interface{}, error)) Retriever {
+	return RetrieverFunc(func(key string) ([]byte, error) {
+		v, err := fn(key)
+		if err != nil {
+			return nil, err
+		}
+		return c.Marshal(v)
+	})
+}
+
+// Typed 包装 Group 返回解码后的对象
+type Typed struct {
+	group    *Group
+	codec    Codec
+	newValue func() interface{}
+	memo     *memo // 为空时每次都解码
+}
+
+// TypedOption 配置 Typed 的可选项
+type TypedOption func(*Typed)
+
+// WithMemo 保留解码后的对象 最多保留编码后总大小为maxBytes的对象
+// 缓存中的value未改变时 Get 直接返回保留的对象
+func WithMemo(maxBytes int64) TypedOption {
+	return func(t *Typed) {
+		t.memo = &memo{lru: lru.New(maxBytes, nil)}
+	}
+}
+
+// NewTyped 使用c包装g newValue返回用于解码的新对象 必须是指针
+// 例如 func() interface{} { return new(User) }
+func NewTyped(g *Group, c Codec, newValue func() interface{}, opts ...TypedOption) *Typed {
+	t := &Typed{group: g, codec: c, newValue: newValue}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Get 返回key对应的对象 类型与newValue返回的相同
+// 启用memo时返回的对象与其他调用方共享 调用方不能修改
+func (t *Typed) Get(key string) (interface{}, error) {
+	view, err := t.group.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if t.memo != nil {
+		if v, ok := t.memo.get(key, view); ok {
+			return v, nil
+		}
+	}
+	v := t.newValue()
+	if err := t.decode(key, view, v); err != nil {
+		return nil, err
+	}
+	if t.memo != nil {
+		t.memo.add(key, view, v)
+	}
+	return v, nil
+}
+
+// GetInto 将key对应的value解码到v v必须是指针
+// 不使用memo 调用方可以随意修改v
+func (t *Typed) GetInto(key string, v interface{}) error {
+	view, err := t.group.Get(key)
+	if err != nil {
+		return err
+	}
+	return t.decode(key, view, v)
+}
+
+func (t *Typed) decode(key string, view ByteView, v interface{}) error {
+	// Codec 只读取value 不会修改或持有 因此不需要复制
+	if err := t.codec.Unmarshal(view.bytes(), v); err != nil {
+		return fmt.Errorf("could not decode %s/%s with %s: %w", t.group.name, key, t.codec.Name(), err)
+	}
+	return nil
+}
+
+// memo 保留解码后的对象 并记录对象是由哪个value解码的
+type memo struct {
+	mu  sync.Mutex
+	lru *lru.Cache
+}
+
+type memoEntry struct {
+	view ByteView
+	v    interface{}
+}
+
+// Len 以编码后的大小近似对象占用的内存
+func (e *memoEntry) Len() int {
+	return e.view.Len()
+}
+
+// get 返回由与view相同的value解码的对象
+func (m *memo) get(key string, view ByteView) (interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	// 比较内容的代价比解码小得多
+	if entry := e.(*memoEntry); entry.view.Equal(view) {
+		return entry.v, true
+	}
+	return nil, false
+}
+
+func (m *memo) add(key string, view ByteView, v interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.Add(key, &memoEntry{view: view, v: v})
+}
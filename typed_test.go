@@ -0,0 +1,96 @@
+// Copyright 2021 Peanutzhen. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package peanutcache
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	pb "github.com/peanutzhen/peanutcache/peanutcachepb"
+	"google.golang.org/protobuf/proto"
+)
+
+type user struct {
+	Name string
+	Age  int
+	Tags []string
+}
+
+func TestTyped_Codecs(t *testing.T) {
+	users := map[string]*user{"zls": {Name: "zls", Age: 21, Tags: []string{"a", "b"}}}
+	retrieve := func(key string) (interface{}, error) {
+		if u, ok := users[key]; ok {
+			return u, nil
+		}
+		return nil, ErrNotFound
+	}
+	node := NewNode()
+	for _, c := range []Codec{JSON, Gob, Msgpack} {
+		g := node.NewGroup("typed-"+c.Name(), 0, EncodeRetriever(c, retrieve))
+		typed := NewTyped(g, c, func() interface{} { return new(user) })
+		v, err := typed.Get("zls")
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name(), err)
+		}
+		if !reflect.DeepEqual(v, users["zls"]) {
+			t.Fatalf("%s: got %+v", c.Name(), v)
+		}
+		var u user
+		if err := typed.GetInto("zls", &u); err != nil || !reflect.DeepEqual(&u, users["zls"]) {
+			t.Fatalf("%s: GetInto got %+v, %v", c.Name(), u, err)
+		}
+		if _, err := typed.Get("unknown"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: unknown key got %v", c.Name(), err)
+		}
+	}
+
+	g := node.NewGroup("typed-protobuf", 0, EncodeRetriever(Protobuf, func(key string) (interface{}, error) {
+		return &pb.GetRequest{Group: "scores", Key: key}, nil
+	}))
+	typed := NewTyped(g, Protobuf, func() interface{} { return new(pb.GetRequest) })
+	v, err := typed.Get("zls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&pb.GetRequest{Group: "scores", Key: "zls"}); !proto.Equal(v.(*pb.GetRequest), want) {
+		t.Fatalf("protobuf: got %v", v)
+	}
+	if _, err := Protobuf.Marshal(&user{}); err == nil {
+		t.Fatal("protobuf codec should reject non-proto values")
+	}
+}
+
+// countingCodec 记录解码次数
+type countingCodec struct {
+	Codec
+	decodes int
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	c.decodes++
+	return c.Codec.Unmarshal(data, v)
+}
+
+func TestTyped_Memo(t *testing.T) {
+	c := &countingCodec{Codec: JSON}
+	node := NewNode()
+	g := node.NewGroup("memo", 0, EncodeRetriever(c, func(key string) (interface{}, error) {
+		return &user{Name: key}, nil
+	}))
+	typed := NewTyped(g, c, func() interface{} { return new(user) }, WithMemo(1<<20))
+	first, _ := typed.Get("zls")
+	second, _ := typed.Get("zls")
+	if first != second || c.decodes != 1 {
+		t.Fatalf("memo should return the decoded object, decodes = %d", c.decodes)
+	}
+
+	// value改变后重新解码
+	g.populateCache("zls", NewByteView([]byte(`{"Name":"peanut"}`)))
+	v, _ := typed.Get("zls")
+	if v.(*user).Name != "peanut" || c.decodes != 2 {
+		t.Fatalf("got %+v after update, decodes = %d", v, c.decodes)
+	}
+}
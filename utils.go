@@ -6,7 +6,9 @@ package peanutcache
 
 import (
 	"fmt"
+	"net"
 	"runtime"
+	"strconv"
 	"strings"
 )
 
@@ -26,15 +28,12 @@ func trace(errorMessage string) string {
 	return str.String()
 }
 
-// 判断是否满足 x.x.x.x:port 的格式
+// 判断是否满足 host:port 的格式 host可以是IP或主机名(例如DNS SRV记录的target)
 func validPeerAddr(addr string) bool {
-	token1 := strings.Split(addr, ":")
-	if len(token1) != 2 {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
 		return false
 	}
-	token2 := strings.Split(token1[0], ".")
-	if token1[0] != "localhost" && len(token2) != 4 {
-		return false
-	}
-	return true
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 0 && n <= 65535
 }